@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errUnauthorized — сервер ответил 401 на запрос с JWT: токен истёк или отозван.
+var errUnauthorized = errors.New("401: токен невалиден")
+
+// jwtMinRefreshMargin — не позже чем за столько до exp токен обновляется повторным чек-ином.
+const jwtMinRefreshMargin = 5 * time.Minute
+
+// checkInTimeout — сколько ждём сервер при чек-ине (оба запроса вместе).
+const checkInTimeout = 30 * time.Second
+
+// auth выполняет чек-ин и следит за сроком жизни JWT: обновляет токен до истечения
+// и сразу после 401 от сервера.
+type auth struct {
+	ctx       context.Context // отменяется при завершении процесса
+	serverURL string
+	mac       string
+	key       ed25519.PrivateKey // ключ устройства для подписи чек-ина
+	// checkedIn получает сигнал после каждого успешного чек-ина (буфер 1, лишние сигналы отбрасываются)
+	checkedIn chan struct{}
+
+	mu sync.Mutex // один чек-ин за раз
+}
+
+func newAuth(ctx context.Context, serverURL, mac string, key ed25519.PrivateKey) *auth {
+	return &auth{ctx: ctx, serverURL: serverURL, mac: mac, key: key, checkedIn: make(chan struct{}, 1)}
+}
+
+// checkIn делает чек-ин и сохраняет токен. Пустой токен без ошибки — устройство ждёт назначения группы.
+func (a *auth) checkIn() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ctx, cancel := context.WithTimeout(a.ctx, checkInTimeout)
+	defer cancel()
+	jwt, err := checkIn(ctx, a.serverURL, a.mac, a.key)
+	if errors.Is(err, errEnrollmentPending) {
+		logAuth.Info("ключ устройства ожидает подтверждения администратором (202)", "fingerprint", keyFingerprint(a.key.Public().(ed25519.PublicKey)))
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if jwt == "" {
+		logAuth.Info("устройство ожидает назначения группы (401)")
+		return "", nil
+	}
+	if err := saveJWT(jwt); err != nil {
+		return "", fmt.Errorf("save JWT: %w", err)
+	}
+	if exp, ok := jwtExpiry(jwt); ok {
+		logAuth.Info("чек-ин выполнен, токен сохранён", "expires", exp.Local().Format("2006-01-02 15:04"))
+	} else {
+		logAuth.Info("чек-ин выполнен, токен сохранён")
+	}
+	select {
+	case a.checkedIn <- struct{}{}:
+	default:
+	}
+	return jwt, nil
+}
+
+// token возвращает сохранённый JWT; пустая строка — токена нет или он истёк. Сам чек-ин не делает:
+// заранее токен обновляет горутина чек-ина (см. refreshIn), чтобы медленный сервер не задерживал
+// основной цикл и переключение плейлиста по расписанию.
+func (a *auth) token() string {
+	jwt, _ := loadJWT()
+	if exp, ok := jwtExpiry(jwt); ok && !time.Now().Before(exp) {
+		return ""
+	}
+	return jwt
+}
+
+// do выполняет запрос с JWT; на 401 выбрасывает токен, сразу делает чек-ин и повторяет запрос один раз.
+func (a *auth) do(req func(jwt string) error) error {
+	jwt := a.token()
+	if jwt == "" {
+		return fmt.Errorf("нет JWT")
+	}
+	err := req(jwt)
+	if !errors.Is(err, errUnauthorized) {
+		return err
+	}
+	logAuth.Warn("401 — сбрасываю JWT и повторяю чек-ин", "status", 401)
+	_ = removeJWT()
+	if jwt, err = a.checkIn(); err != nil {
+		return fmt.Errorf("check-in после 401: %w", err)
+	}
+	if jwt == "" {
+		return errUnauthorized
+	}
+	return req(jwt)
+}
+
+// refreshIn возвращает, через сколько пора обновить текущий токен; ok=false — срок неизвестен.
+func (a *auth) refreshIn(now time.Time) (time.Duration, bool) {
+	jwt, _ := loadJWT()
+	exp, ok := jwtExpiry(jwt)
+	if !ok {
+		return 0, false
+	}
+	return exp.Add(-jwtRefreshMargin(jwt)).Sub(now), true
+}
+
+// jwtClaims — поля полезной нагрузки JWT, которые нужны клиенту (подпись не проверяем — это дело сервера).
+type jwtClaims struct {
+	Exp float64 `json:"exp"`
+	Iat float64 `json:"iat"`
+}
+
+func parseJWTClaims(token string) (jwtClaims, bool) {
+	var c jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return c, false
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return c, false
+	}
+	return c, true
+}
+
+// jwtExpiry возвращает exp токена; ok=false — токен без exp или не JWT.
+func jwtExpiry(token string) (time.Time, bool) {
+	c, ok := parseJWTClaims(token)
+	if !ok || c.Exp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(c.Exp), 0), true
+}
+
+// jwtRefreshMargin — за сколько до exp обновлять: десятая часть срока жизни, но не меньше jwtMinRefreshMargin.
+func jwtRefreshMargin(token string) time.Duration {
+	c, _ := parseJWTClaims(token)
+	if c.Iat > 0 && c.Exp > c.Iat {
+		if m := time.Duration(c.Exp-c.Iat) * time.Second / 10; m > jwtMinRefreshMargin {
+			return m
+		}
+	}
+	return jwtMinRefreshMargin
+}
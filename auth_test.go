@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+// testJWT собирает неподписанный JWT с заданным payload: подпись клиент не проверяет.
+func testJWT(payload string) string {
+	return "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestJWTExpiry(t *testing.T) {
+	tests := []struct {
+		token string
+		want  time.Time
+		ok    bool
+	}{
+		{testJWT(`{"exp":1767225600}`), time.Unix(1767225600, 0), true},
+		{testJWT(`{"exp":1767225600.9}`), time.Unix(1767225600, 0), true},
+		{testJWT(`{"iat":1767225600}`), time.Time{}, false},
+		{testJWT(`{"exp":0}`), time.Time{}, false},
+		{testJWT(`not json`), time.Time{}, false},
+		{"opaque-token", time.Time{}, false},
+		{"a.!!!.c", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := jwtExpiry(tt.token)
+		if !got.Equal(tt.want) || ok != tt.ok {
+			t.Errorf("jwtExpiry(%q) = %s, %v; want %s, %v", tt.token, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestJWTRefreshMargin(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  time.Duration
+	}{
+		{"десятая часть суток", testJWT(`{"iat":1000,"exp":87400}`), 144 * time.Minute},
+		{"короткий токен — минимум", testJWT(`{"iat":1000,"exp":3400}`), jwtMinRefreshMargin},
+		{"ровно минимум", testJWT(`{"iat":1000,"exp":4000}`), jwtMinRefreshMargin},
+		{"без iat", testJWT(`{"exp":87400}`), jwtMinRefreshMargin},
+		{"exp раньше iat", testJWT(`{"iat":87400,"exp":1000}`), jwtMinRefreshMargin},
+		{"не JWT", "opaque-token", jwtMinRefreshMargin},
+	}
+	for _, tt := range tests {
+		if got := jwtRefreshMargin(tt.token); got != tt.want {
+			t.Errorf("%s: jwtRefreshMargin = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultConfigFile — файл настроек в формате KEY=VALUE (как EnvironmentFile у systemd).
+// Переменные окружения важнее значений из файла. Путь можно сменить через CONFIG_FILE.
+const defaultConfigFile = "/etc/mediaplayer.conf"
+
+// fileConfig — значения из файла настроек (заполняется loadConfig, меняется по SIGHUP).
+var (
+	fileConfigMu sync.RWMutex
+	fileConfig   = map[string]string{}
+)
+
+type config struct {
+	ServerURL string
+	MediaDir  string
+	// StateDir — токен, манифест, логи и служебные файлы (STATE_DIR)
+	StateDir string
+
+	// CheckInInterval — период чек-ина (CHECKIN_INTERVAL)
+	CheckInInterval time.Duration
+	// SyncTimes — ежедневные синхронизации, минуты от начала суток (SYNC_TIMES="04:00,13:30")
+	SyncTimes []int
+	// SyncInterval — периодическая синхронизация, 0 — выключена (SYNC_INTERVAL)
+	SyncInterval time.Duration
+	// SyncJitter — случайная задержка к каждой плановой синхронизации (SYNC_JITTER)
+	SyncJitter time.Duration
+	// PushEnabled — держать канал команд GET /device/me/events (PUSH_ENABLED, по умолчанию включён)
+	PushEnabled bool
+	// HeartbeatInterval — период отправки телеметрии, 0 — выключена (HEARTBEAT_INTERVAL)
+	HeartbeatInterval time.Duration
+	// LogFormat — "text" или "json" (LOG_FORMAT), LogLevel — debug, info, warn, error (LOG_LEVEL)
+	LogFormat string
+	LogLevel  slog.Level
+	// Logs — ротация логов в STATE_DIR/log (LOG_MAX_SIZE, LOG_ROTATE_INTERVAL, LOG_MAX_AGE, LOG_MAX_TOTAL)
+	Logs logPolicy
+
+	// TLSCAFile — дополнительные корневые сертификаты в PEM (TLS_CA_FILE)
+	TLSCAFile string
+	// TLSPins — SHA-256 ключей (SPKI), которым доверяем для хоста SERVER_URL (TLS_PIN_SHA256)
+	TLSPins []string
+	// TLSInsecureHosts — медиа-хосты, для которых сертификат не проверяется (TLS_INSECURE_HOSTS)
+	TLSInsecureHosts []string
+	// TLSClientCert, TLSClientKey — сертификат устройства для mTLS (TLS_CLIENT_CERT, TLS_CLIENT_KEY)
+	TLSClientCert, TLSClientKey string
+
+	// DownloadConcurrency — сколько файлов качается одновременно (DOWNLOAD_CONCURRENCY)
+	DownloadConcurrency int
+	// DownloadRate — общее ограничение скорости загрузок (DOWNLOAD_RATE_LIMIT, DOWNLOAD_RATE_SCHEDULE)
+	DownloadRate ratePolicy
+	// MinFreeSpace — сколько места на диске MEDIA_DIR оставлять свободным при загрузке (MIN_FREE_SPACE)
+	MinFreeSpace int64
+
+	// DeviceIDSource — чем представляется устройство при чек-ине: "mac" или "machine-id" (DEVICE_ID_SOURCE)
+	DeviceIDSource string
+	// DeviceInterface — интерфейс, MAC которого берётся идентификатором (DEVICE_INTERFACE)
+	DeviceInterface string
+}
+
+// loadConfig читает файл настроек и собирает config из окружения, файла и значений по умолчанию.
+func loadConfig() (config, error) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		path = defaultConfigFile
+	}
+	values, err := readConfigFile(path)
+	if err != nil && !(os.IsNotExist(err) && os.Getenv("CONFIG_FILE") == "") {
+		return config{}, fmt.Errorf("config %s: %w", path, err)
+	}
+	fileConfigMu.Lock()
+	fileConfig = values
+	fileConfigMu.Unlock()
+
+	cfg := config{
+		ServerURL: getEnv("SERVER_URL", "https://statosphera.ru/api/media-player"),
+		MediaDir:  getEnv("MEDIA_DIR", mediaDir),
+		StateDir:  getEnv("STATE_DIR", defaultStateDir),
+	}
+	if cfg.CheckInInterval, err = getDuration("CHECKIN_INTERVAL", 10*time.Minute); err != nil {
+		return config{}, err
+	}
+	if cfg.SyncInterval, err = getDuration("SYNC_INTERVAL", 0); err != nil {
+		return config{}, err
+	}
+	if cfg.SyncJitter, err = getDuration("SYNC_JITTER", 5*time.Minute); err != nil {
+		return config{}, err
+	}
+	if cfg.HeartbeatInterval, err = getDuration("HEARTBEAT_INTERVAL", 5*time.Minute); err != nil {
+		return config{}, err
+	}
+	cfg.LogFormat = strings.ToLower(getEnv("LOG_FORMAT", "text"))
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return config{}, fmt.Errorf("LOG_FORMAT=%q: ожидается text или json", cfg.LogFormat)
+	}
+	if err := cfg.LogLevel.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		return config{}, fmt.Errorf("LOG_LEVEL=%q: ожидается debug, info, warn или error", getEnv("LOG_LEVEL", "info"))
+	}
+	if cfg.Logs.MaxSize, err = getSize("LOG_MAX_SIZE", defaultLogPolicy.MaxSize); err != nil {
+		return config{}, err
+	}
+	if cfg.Logs.MaxTotal, err = getSize("LOG_MAX_TOTAL", defaultLogPolicy.MaxTotal); err != nil {
+		return config{}, err
+	}
+	if cfg.Logs.RotateInterval, err = getDuration("LOG_ROTATE_INTERVAL", defaultLogPolicy.RotateInterval); err != nil {
+		return config{}, err
+	}
+	if cfg.Logs.MaxAge, err = getDuration("LOG_MAX_AGE", defaultLogPolicy.MaxAge); err != nil {
+		return config{}, err
+	}
+	if cfg.SyncTimes, err = parseSyncTimes(getEnv("SYNC_TIMES", "04:00")); err != nil {
+		return config{}, err
+	}
+	cfg.PushEnabled = getEnv("PUSH_ENABLED", "1") != "0"
+	if cfg.DownloadConcurrency, err = strconv.Atoi(getEnv("DOWNLOAD_CONCURRENCY", "2")); err != nil || cfg.DownloadConcurrency < 1 || cfg.DownloadConcurrency > 16 {
+		return config{}, fmt.Errorf("DOWNLOAD_CONCURRENCY=%q: ожидается число от 1 до 16", getEnv("DOWNLOAD_CONCURRENCY", "2"))
+	}
+	if cfg.MinFreeSpace, err = getSize("MIN_FREE_SPACE", 100<<20); err != nil {
+		return config{}, err
+	}
+	if cfg.DownloadRate.Rate, err = getSize("DOWNLOAD_RATE_LIMIT", 0); err != nil {
+		return config{}, err
+	}
+	if cfg.DownloadRate.Windows, err = parseRateSchedule(getEnv("DOWNLOAD_RATE_SCHEDULE", "")); err != nil {
+		return config{}, err
+	}
+	cfg.TLSCAFile = getEnv("TLS_CA_FILE", "")
+	cfg.TLSPins = splitList(getEnv("TLS_PIN_SHA256", ""))
+	cfg.TLSInsecureHosts = splitList(getEnv("TLS_INSECURE_HOSTS", ""))
+	cfg.TLSClientCert, cfg.TLSClientKey = getEnv("TLS_CLIENT_CERT", ""), getEnv("TLS_CLIENT_KEY", "")
+	cfg.DeviceIDSource = strings.ToLower(getEnv("DEVICE_ID_SOURCE", "mac"))
+	if cfg.DeviceIDSource != "mac" && cfg.DeviceIDSource != "machine-id" {
+		return config{}, fmt.Errorf("DEVICE_ID_SOURCE=%q: ожидается mac или machine-id", cfg.DeviceIDSource)
+	}
+	cfg.DeviceInterface = getEnv("DEVICE_INTERFACE", "")
+	if (cfg.TLSClientCert == "") != (cfg.TLSClientKey == "") {
+		return config{}, fmt.Errorf("TLS_CLIENT_CERT и TLS_CLIENT_KEY задаются вместе")
+	}
+	if cfg.CheckInInterval < time.Minute {
+		return config{}, fmt.Errorf("CHECKIN_INTERVAL=%s: минимум 1m", cfg.CheckInInterval)
+	}
+	if cfg.SyncInterval != 0 && cfg.SyncInterval < time.Minute {
+		return config{}, fmt.Errorf("SYNC_INTERVAL=%s: минимум 1m", cfg.SyncInterval)
+	}
+	if cfg.Logs.MaxSize < 64<<10 {
+		return config{}, fmt.Errorf("LOG_MAX_SIZE=%d: минимум 64K", cfg.Logs.MaxSize)
+	}
+	if cfg.HeartbeatInterval != 0 && cfg.HeartbeatInterval < 30*time.Second {
+		return config{}, fmt.Errorf("HEARTBEAT_INTERVAL=%s: минимум 30s", cfg.HeartbeatInterval)
+	}
+	return cfg, nil
+}
+
+// readConfigFile разбирает строки KEY=VALUE; пустые строки и # комментарии пропускаются.
+func readConfigFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	f, err := os.Open(path)
+	if err != nil {
+		return values, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return values, fmt.Errorf("строка %d: ожидается KEY=VALUE", n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, sc.Err()
+}
+
+// configValue возвращает настройку: из окружения, иначе из файла настроек.
+func configValue(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	fileConfigMu.RLock()
+	defer fileConfigMu.RUnlock()
+	return fileConfig[key]
+}
+
+// reloadConfig перечитывает настройки по SIGHUP. При ошибке остаются старые. SERVER_URL, MEDIA_DIR,
+// STATE_DIR, PUSH_ENABLED, HEARTBEAT_INTERVAL, LOG_FORMAT, TLS_* и DEVICE_* применяются только после перезапуска процесса.
+func reloadConfig(old config) config {
+	cfg, err := loadConfig()
+	if err != nil {
+		logMain.Error("SIGHUP: настройки с ошибкой, оставляю прежние", "err", err)
+		return old
+	}
+	if abs, _ := filepath.Abs(cfg.MediaDir); cfg.ServerURL != old.ServerURL || cfg.StateDir != old.StateDir || abs != old.MediaDir {
+		logMain.Warn("SIGHUP: SERVER_URL, MEDIA_DIR и STATE_DIR применятся после перезапуска")
+	}
+	cfg.ServerURL, cfg.MediaDir, cfg.StateDir, cfg.PushEnabled = old.ServerURL, old.MediaDir, old.StateDir, old.PushEnabled
+	cfg.HeartbeatInterval, cfg.LogFormat = old.HeartbeatInterval, old.LogFormat
+	cfg.TLSCAFile, cfg.TLSPins, cfg.TLSInsecureHosts = old.TLSCAFile, old.TLSPins, old.TLSInsecureHosts
+	cfg.TLSClientCert, cfg.TLSClientKey = old.TLSClientCert, old.TLSClientKey
+	cfg.DeviceIDSource, cfg.DeviceInterface = old.DeviceIDSource, old.DeviceInterface
+	logMain.Info("SIGHUP: настройки перечитаны", "checkin_interval", cfg.CheckInInterval.String(), "sync_times", getEnv("SYNC_TIMES", "04:00"),
+		"sync_interval", cfg.SyncInterval.String(), "sync_jitter", cfg.SyncJitter.String(), "log_level", cfg.LogLevel.String(),
+		"download_concurrency", cfg.DownloadConcurrency, "download_rate", cfg.DownloadRate.rateAt(time.Now()))
+	return cfg
+}
+
+// getDuration читает длительность в формате Go ("10m", "1h30m"); "0" — выключено.
+func getDuration(key string, def time.Duration) (time.Duration, error) {
+	v := configValue(key)
+	if v == "" {
+		return def, nil
+	}
+	if v == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s=%q: ожидается длительность, например 10m", key, v)
+	}
+	return d, nil
+}
+
+// getSize читает размер в байтах: "500K", "5M", "1G" (можно с B на конце) или просто число; "0" — без ограничения.
+func getSize(key string, def int64) (int64, error) {
+	v := configValue(key)
+	if strings.TrimSpace(v) == "" {
+		return def, nil
+	}
+	n, ok := parseSize(v)
+	if !ok {
+		return 0, fmt.Errorf("%s=%q: ожидается размер, например 5M", key, v)
+	}
+	return n, nil
+}
+
+// parseSize разбирает размер для getSize.
+func parseSize(s string) (int64, bool) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return int64(n * float64(mult)), true
+}
+
+// splitList разбирает список через запятую, пропуская пустые элементы.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// parseSyncTimes разбирает "04:00,13:30" в отсортированные минуты от начала суток; "" или "off" — нет.
+func parseSyncTimes(s string) ([]int, error) {
+	var out []int
+	if s == "off" {
+		return nil, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		m, err := parseClock(part, 0)
+		if err != nil || m >= 24*60 {
+			return nil, fmt.Errorf("SYNC_TIMES: время %q: ожидается HH:MM", part)
+		}
+		out = append(out, m)
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+// nextSyncTime возвращает момент следующей плановой синхронизации после синхронизации в last:
+// ближайшее из SyncTimes и last+SyncInterval, плюс случайный сдвиг до SyncJitter.
+// Нулевое время — плановых синхронизаций нет.
+func (c config) nextSyncTime(now, last time.Time) time.Time {
+	var next time.Time
+	for _, m := range c.SyncTimes {
+		t := time.Date(now.Year(), now.Month(), now.Day(), m/60, m%60, 0, 0, now.Location())
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	if c.SyncInterval > 0 {
+		t := last.Add(c.SyncInterval)
+		if t.Before(now) {
+			t = now
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	if next.IsZero() {
+		return next
+	}
+	if c.SyncJitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(c.SyncJitter))))
+	}
+	// Round(0) убирает монотонные часы: сравниваем по настенному времени (его правит NTP после загрузки)
+	return next.Round(0)
+}
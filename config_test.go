@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextSyncTime(t *testing.T) {
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 1, day, hour, min, 0, 0, time.Local) }
+	tests := []struct {
+		name      string
+		cfg       config
+		now, last time.Time
+		want      time.Time
+	}{
+		{"нет расписания", config{}, at(5, 10, 0), at(5, 10, 0), time.Time{}},
+		{"сегодня", config{SyncTimes: []int{4 * 60, 13*60 + 30}}, at(5, 10, 0), at(5, 10, 0), at(5, 13, 30)},
+		{"завтра", config{SyncTimes: []int{4 * 60}}, at(5, 10, 0), at(5, 10, 0), at(6, 4, 0)},
+		{"ровно сейчас — завтра", config{SyncTimes: []int{4 * 60}}, at(5, 4, 0), at(5, 4, 0), at(6, 4, 0)},
+		{"интервал", config{SyncInterval: time.Hour}, at(5, 10, 0), at(5, 9, 30), at(5, 10, 30)},
+		{"интервал просрочен", config{SyncInterval: time.Hour}, at(5, 10, 0), at(5, 8, 0), at(5, 10, 0)},
+		{"интервал раньше времени", config{SyncTimes: []int{13 * 60}, SyncInterval: time.Hour}, at(5, 10, 0), at(5, 10, 0), at(5, 11, 0)},
+		{"время раньше интервала", config{SyncTimes: []int{10*60 + 15}, SyncInterval: time.Hour}, at(5, 10, 0), at(5, 10, 0), at(5, 10, 15)},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.nextSyncTime(tt.now, tt.last); !got.Equal(tt.want) {
+			t.Errorf("%s: nextSyncTime = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNextSyncTimeJitter(t *testing.T) {
+	now := time.Date(2026, 1, 5, 10, 0, 0, 0, time.Local)
+	cfg := config{SyncTimes: []int{11 * 60}, SyncJitter: 10 * time.Minute}
+	base := time.Date(2026, 1, 5, 11, 0, 0, 0, time.Local)
+	for i := 0; i < 100; i++ {
+		got := cfg.nextSyncTime(now, now)
+		if got.Before(base) || !got.Before(base.Add(cfg.SyncJitter)) {
+			t.Fatalf("nextSyncTime = %s, want в [%s, %s)", got, base, base.Add(cfg.SyncJitter))
+		}
+	}
+}
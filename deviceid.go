@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// deviceIDFile — выбранный идентификатор устройства в STATE_DIR. Однажды выбранный MAC не меняется,
+// даже если потом появятся USB-донгл, docker0 или VPN: иначе сервер видит новое незарегистрированное устройство.
+const deviceIDFile = "device-id.json"
+
+// machineIDFiles — где искать machine-id для DEVICE_ID_SOURCE=machine-id.
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+type storedDeviceID struct {
+	ID        string `json:"id"`
+	Source    string `json:"source"`              // "mac" или "machine-id"
+	Interface string `json:"interface,omitempty"` // откуда взят MAC
+}
+
+// deviceID возвращает идентификатор для чек-ина. source "machine-id" — содержимое /etc/machine-id;
+// иначе MAC: интерфейса iface (DEVICE_INTERFACE), если он задан, или ранее сохранённый, или лучшего
+// из физических интерфейсов (см. pickInterface). Пустая строка — идентификатор не найден.
+func deviceID(source, iface string) string {
+	stored := loadDeviceID()
+	var id storedDeviceID
+	switch {
+	case source == "machine-id":
+		mid, err := readMachineID()
+		if err != nil {
+			logAuth.Error("machine-id не читается", "err", err)
+			return ""
+		}
+		id = storedDeviceID{ID: mid, Source: source}
+	case iface != "":
+		ni, err := net.InterfaceByName(iface)
+		if err == nil && len(ni.HardwareAddr) >= 6 {
+			id = storedDeviceID{ID: formatMAC(ni.HardwareAddr), Source: "mac", Interface: iface}
+		} else if stored.Source == "mac" && stored.Interface == iface {
+			// интерфейс ещё не поднялся (USB) — его MAC уже известен
+			logAuth.Warn("DEVICE_INTERFACE не найден, использую сохранённый MAC", "interface", iface, "mac", stored.ID)
+			return stored.ID
+		} else {
+			logAuth.Error("DEVICE_INTERFACE не найден или без MAC", "interface", iface)
+			return ""
+		}
+	case stored.Source == "mac" && stored.ID != "":
+		if !macPresent(stored.ID) {
+			logAuth.Warn("сохранённый MAC не найден среди интерфейсов, идентификатор не меняю", "mac", stored.ID, "interface", stored.Interface)
+		}
+		return stored.ID
+	default:
+		var ni net.Interface
+		var ok bool
+		if _, err := os.Stat(statePath(jwtFile)); err == nil {
+			// устройство уже зарегистрировано старой версией — сохраняем MAC, под которым его знает сервер
+			ni, ok = legacyInterface()
+		} else if ni, ok = pickInterface(false); !ok {
+			// у части плат MAC генерирует драйвер — лучше такой, чем никакого
+			ni, ok = pickInterface(true)
+		}
+		if !ok {
+			logAuth.Error("физический сетевой интерфейс с MAC не найден; задайте DEVICE_INTERFACE или DEVICE_ID_SOURCE=machine-id")
+			return ""
+		}
+		id = storedDeviceID{ID: formatMAC(ni.HardwareAddr), Source: "mac", Interface: ni.Name}
+		if caveat := macCaveat(ni); caveat != "" && id != stored {
+			logAuth.Warn("идентификатор устройства — MAC, который может смениться; закрепите DEVICE_INTERFACE или DEVICE_ID_SOURCE=machine-id",
+				"interface", ni.Name, "mac", id.ID, "reason", caveat)
+		}
+	}
+	if id != stored {
+		if stored.ID != "" && stored.ID != id.ID {
+			logAuth.Warn("идентификатор устройства изменён", "old", stored.ID, "new", id.ID, "source", id.Source)
+		}
+		if err := saveDeviceID(id); err != nil {
+			logAuth.Error("идентификатор устройства не сохранён", "err", err)
+		}
+	}
+	return id.ID
+}
+
+// pickInterface выбирает интерфейс, MAC которого станет идентификатором: только физические
+// (есть /sys/class/net/<имя>/device); сначала встроенные ethernet, затем встроенный Wi-Fi, затем
+// USB-адаптеры; при равенстве — по имени. Локально администрируемые MAC (случайные у Wi-Fi,
+// сгенерированные драйвером у части плат) подходят, только если allowLocal.
+func pickInterface(allowLocal bool) (net.Interface, bool) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return net.Interface{}, false
+	}
+	type candidate struct {
+		iface net.Interface
+		rank  int
+	}
+	var cs []candidate
+	for _, iface := range interfaces {
+		a := iface.HardwareAddr
+		if iface.Flags&net.FlagLoopback != 0 || len(a) != 6 || isZeroMAC(a) || (isLocalMAC(a) && !allowLocal) {
+			continue
+		}
+		dev, err := filepath.EvalSymlinks(filepath.Join("/sys/class/net", iface.Name, "device"))
+		if err != nil {
+			continue // виртуальный: bridge, veth, tun, docker0
+		}
+		rank := 0
+		switch interfaceType(iface.Name) {
+		case "ethernet":
+		case "wifi":
+			rank = 1
+		default:
+			rank = 2
+		}
+		if strings.Contains(dev, "/usb") {
+			rank += 3
+		}
+		cs = append(cs, candidate{iface, rank})
+	}
+	if len(cs) == 0 {
+		return net.Interface{}, false
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].rank != cs[j].rank {
+			return cs[i].rank < cs[j].rank
+		}
+		return cs[i].iface.Name < cs[j].iface.Name
+	})
+	return cs[0].iface, true
+}
+
+// legacyInterface — первый не-loopback интерфейс с MAC (выбор до появления device-id.json).
+func legacyInterface() (net.Interface, bool) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return net.Interface{}, false
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback == 0 && len(iface.HardwareAddr) >= 6 {
+			return iface, true
+		}
+	}
+	return net.Interface{}, false
+}
+
+// macCaveat объясняет, почему MAC интерфейса может смениться: виртуальный интерфейс
+// или локально администрируемый адрес. Пустая строка — MAC надёжный.
+func macCaveat(iface net.Interface) string {
+	if _, err := os.Stat(filepath.Join("/sys/class/net", iface.Name, "device")); err != nil {
+		return "виртуальный интерфейс"
+	}
+	if isLocalMAC(iface.HardwareAddr) {
+		return "локально администрируемый MAC"
+	}
+	return ""
+}
+
+// isLocalMAC сообщает, что MAC локально администрируемый (бит 0x02 первого байта): его назначила
+// программа или драйвер, а не производитель.
+func isLocalMAC(a net.HardwareAddr) bool {
+	return len(a) > 0 && a[0]&0x02 != 0
+}
+
+func isZeroMAC(a net.HardwareAddr) bool {
+	for _, b := range a {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// formatMAC возвращает MAC в формате "AA:BB:CC:DD:EE:FF".
+func formatMAC(a net.HardwareAddr) string {
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", a[0], a[1], a[2], a[3], a[4], a[5])
+}
+
+// macPresent сообщает, есть ли интерфейс с таким MAC.
+func macPresent(mac string) bool {
+	interfaces, _ := net.Interfaces()
+	for _, iface := range interfaces {
+		if len(iface.HardwareAddr) >= 6 && formatMAC(iface.HardwareAddr) == mac {
+			return true
+		}
+	}
+	return false
+}
+
+func readMachineID() (string, error) {
+	var lastErr error
+	for _, path := range machineIDFiles {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if id := strings.TrimSpace(string(b)); id != "" && id != "uninitialized" {
+			return id, nil
+		}
+		lastErr = fmt.Errorf("%s: пустой", path)
+	}
+	return "", lastErr
+}
+
+func loadDeviceID() storedDeviceID {
+	var id storedDeviceID
+	unlock, err := lockState(false)
+	if err != nil {
+		return id
+	}
+	b, err := os.ReadFile(statePath(deviceIDFile))
+	unlock()
+	if err == nil {
+		if err := json.Unmarshal(b, &id); err != nil {
+			logAuth.Error("идентификатор устройства не читается", "file", deviceIDFile, "err", err)
+			return storedDeviceID{}
+		}
+	}
+	return id
+}
+
+func saveDeviceID(id storedDeviceID) error {
+	b, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	unlock, err := lockState(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(statePath(deviceIDFile), b, 0644)
+}
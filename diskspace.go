@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errDiskFull — файл не поместится (с учётом MIN_FREE_SPACE) или запись упёрлась в ENOSPC.
+var errDiskFull = errors.New("нет места на диске")
+
+// headTimeout — сколько ждём ответа на HEAD, когда размер файла не пришёл в плейлисте
+// (запрос делает загрузчик прямо перед скачиванием файла).
+const headTimeout = 15 * time.Second
+
+// diskState — результат последней проверки места перед загрузкой; уходит в телеметрию.
+type diskState struct {
+	Full       bool       `json:"full"`                 // какие-то файлы не скачаны из-за места
+	RequiredMB int64      `json:"requiredMb,omitempty"` // сколько не хватило сверх MIN_FREE_SPACE
+	Skipped    int        `json:"skipped,omitempty"`    // сколько файлов не скачано
+	Since      *time.Time `json:"since,omitempty"`      // с какой синхронизации места не хватает
+}
+
+// diskStatus — состояние диска после последней синхронизации (nil — синхронизаций ещё не было).
+var diskStatus atomic.Pointer[diskState]
+
+// setDiskFull запоминает, что skipped файлов (не хватило required байт) не скачано из-за места;
+// skipped=0 — место есть.
+func setDiskFull(skipped int, required int64) {
+	if skipped == 0 {
+		diskStatus.Store(&diskState{})
+		return
+	}
+	now := time.Now()
+	since, became := &now, true
+	if prev := diskStatus.Load(); prev != nil && prev.Full {
+		since, became = prev.Since, false
+	}
+	diskStatus.Store(&diskState{Full: true, RequiredMB: (required + 1<<20 - 1) >> 20, Skipped: skipped, Since: since})
+	if became {
+		select {
+		case heartbeatNow <- struct{}{}: // сервер узнает сразу, а не через HEARTBEAT_INTERVAL
+		default:
+		}
+	}
+}
+
+// freeSpace возвращает свободное для процесса место на файловой системе dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// downloadSize возвращает, сколько байт ещё предстоит скачать для it полным размером size (из плейлиста
+// или из HEAD) с учётом уже скачанного part. -1 — размер неизвестен.
+func downloadSize(it MediaItem, size int64, part string) int64 {
+	if size <= 0 {
+		return -1
+	}
+	if st, err := os.Stat(part); err == nil && loadPartMeta(part).Version == itemVersion(it) {
+		size -= min(st.Size(), size)
+	}
+	return size
+}
+
+func headContentLength(ctx context.Context, url string) int64 {
+	ctx, cancel := context.WithTimeout(ctx, headTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return -1
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	return resp.ContentLength
+}
+
+// evictStale освобождает не меньше need байт в dir, удаляя файлы (и .part), которых нет в keepIDs:
+// сначала самые старые. Файлы нового плейлиста не трогает. Возвращает, сколько байт удалено.
+func evictStale(dir string, keepIDs map[string]bool, need int64) (freed int64) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	type stale struct {
+		path string
+		size int64
+		mod  time.Time
+	}
+	var files []stale
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		id := strings.TrimSuffix(e.Name(), ".part")
+		id = strings.TrimSuffix(id, filepath.Ext(id))
+		info, err := e.Info()
+		if id == "" || keepIDs[id] || err != nil {
+			continue
+		}
+		files = append(files, stale{filepath.Join(dir, e.Name()), info.Size(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+	for _, f := range files {
+		if freed >= need {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			freed += f.size
+			logSync.Info("удалён файл не из плейлиста, чтобы освободить место", "file", filepath.Base(f.path), "size_mb", f.size>>20)
+		}
+	}
+	return freed
+}
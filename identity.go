@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// deviceKeyFile — закрытый ключ устройства (Ed25519, PKCS#8 PEM) в STATE_DIR. Создаётся при первом
+// запуске; открытый ключ администратор подтверждает в админке, и дальше чек-ин без подписи этим ключом
+// не выдаёт токен.
+const deviceKeyFile = "device.key"
+
+// errEnrollmentPending — сервер ответил 202: ключ устройства ещё не подтверждён администратором.
+var errEnrollmentPending = errors.New("ключ устройства ожидает подтверждения")
+
+// loadDeviceKey читает ключ устройства из STATE_DIR, при отсутствии — создаёт новый.
+func loadDeviceKey() (ed25519.PrivateKey, error) {
+	unlock, err := lockState(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	path := statePath(deviceKeyFile)
+	b, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%s: не PEM", path)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: ожидается ключ Ed25519", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	logAuth.Info("создан ключ устройства", "file", path, "fingerprint", keyFingerprint(key.Public().(ed25519.PublicKey)))
+	return key, nil
+}
+
+// publicKeyString — открытый ключ для сервера: 32 байта Ed25519 в base64.
+func publicKeyString(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// keyFingerprint — первые 16 hex-символов SHA-256 открытого ключа: по ним администратор сверяет устройство.
+func keyFingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signCheckIn подписывает одноразовый nonce сервера вместе с MAC, чтобы подпись нельзя было
+// предъявить от имени другого устройства.
+func signCheckIn(key ed25519.PrivateKey, nonce, macAddress string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(nonce+"\n"+macAddress)))
+}
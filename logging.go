@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// logLevel — уровень логов (LOG_LEVEL), меняется по SIGHUP без перезапуска.
+var logLevel slog.LevelVar
+
+// Логгеры подсистем: у каждой записи есть поле component. Переназначаются в setupLogger.
+var (
+	logMain   = slog.Default().With("component", "main")
+	logAuth   = slog.Default().With("component", "auth")
+	logSync   = slog.Default().With("component", "sync")
+	logPlayer = slog.Default().With("component", "player")
+	logPush   = slog.Default().With("component", "push")
+	logReport = slog.Default().With("component", "report") // показы и телеметрия
+	logState  = slog.Default().With("component", "state")  // каталог состояния, блокировки, логи
+)
+
+// setupLogger настраивает вывод: format "text" (по умолчанию, для человека) или "json"
+// (по записи на строку — для journald и сборщиков логов).
+func setupLogger(format string, level slog.Level) {
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if format == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	l := slog.New(h)
+	slog.SetDefault(l)
+	logMain = l.With("component", "main")
+	logAuth = l.With("component", "auth")
+	logSync = l.With("component", "sync")
+	logPlayer = l.With("component", "player")
+	logPush = l.With("component", "push")
+	logReport = l.With("component", "report")
+	logState = l.With("component", "state")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logPolicy — ограничения логов в STATE_DIR/log (LOG_MAX_SIZE, LOG_ROTATE_INTERVAL, LOG_MAX_AGE, LOG_MAX_TOTAL).
+type logPolicy struct {
+	MaxSize        int64         // при таком размере лог уходит в архив
+	RotateInterval time.Duration // и не реже, чем раз в столько (0 — только по размеру)
+	MaxAge         time.Duration // архивы старше удаляются (0 — не удаляются по возрасту)
+	MaxTotal       int64         // все логи вместе с архивами — не больше; сначала удаляются старые архивы
+}
+
+var defaultLogPolicy = logPolicy{MaxSize: 5 << 20, RotateInterval: 24 * time.Hour, MaxAge: 7 * 24 * time.Hour, MaxTotal: 50 << 20}
+
+// logMaxArchives — архивов в каталоге логов не больше: однотипный спам сжимается так хорошо,
+// что без этого ограничения файлы копились бы тысячами.
+const logMaxArchives = 50
+
+// logLimits — действующие ограничения (из config, меняются по SIGHUP).
+var logLimits atomic.Pointer[logPolicy]
+
+func init() { logLimits.Store(&defaultLogPolicy) }
+
+// rotatingLog — файл лога, который сам уходит в архив <имя>.<время>.gz по размеру и возрасту.
+type rotatingLog struct {
+	path string
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// openLog открывает лог на дозапись.
+func openLog(path string) (*rotatingLog, error) {
+	l := &rotatingLog{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size, l.opened = f, st.Size(), time.Now()
+	return nil
+}
+
+func (l *rotatingLog) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	p := logLimits.Load()
+	if l.size > 0 && (l.size+int64(len(b)) > p.MaxSize || (p.RotateInterval > 0 && time.Since(l.opened) >= p.RotateInterval)) {
+		if err := l.rotate(); err != nil {
+			logState.Error("ротация лога не удалась", "file", l.path, "err", err)
+		}
+	}
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate сжимает текущий файл в архив и начинает новый.
+func (l *rotatingLog) rotate() error {
+	l.f.Close()
+	l.f = nil
+	archive := fmt.Sprintf("%s.%s", l.path, time.Now().Format("20060102-150405.000"))
+	renameErr := os.Rename(l.path, archive)
+	if err := l.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	if err := gzipFile(archive); err != nil {
+		return err
+	}
+	pruneLogs(filepath.Dir(l.path))
+	return nil
+}
+
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// gzipFile сжимает path в path.gz и удаляет исходный файл.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+// pruneLogs удаляет архивы старше MaxAge, затем самые старые архивы, пока все файлы каталога
+// не уложатся в MaxTotal и их станет не больше logMaxArchives. Архив — любой файл, кроме действующих *.log (в том числе несжатый
+// после прерванной ротации).
+func pruneLogs(dir string) {
+	p := logLimits.Load()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type archive struct {
+		path string
+		size int64
+		mod  time.Time
+	}
+	var archives []archive
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if !strings.HasSuffix(e.Name(), ".log") {
+			if p.MaxAge > 0 && time.Since(info.ModTime()) > p.MaxAge {
+				os.Remove(path)
+				continue
+			}
+			archives = append(archives, archive{path, info.Size(), info.ModTime()})
+		}
+		total += info.Size()
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].mod.Before(archives[j].mod) })
+	for i, a := range archives {
+		if (p.MaxTotal <= 0 || total <= p.MaxTotal) && len(archives)-i <= logMaxArchives {
+			break
+		}
+		if os.Remove(a.path) == nil {
+			total -= a.size
+		}
+	}
+}
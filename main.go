@@ -1,18 +1,25 @@
-// Медиа-плеер для Orange Pi: чек-ин по MAC, JWT, GET /api/device/me/media, загрузка по id, воспроизведение; синхронизация при получении токена и в 4:00.
+// Медиа-плеер для Orange Pi: чек-ин по MAC, JWT, GET /api/device/me/media, загрузка по id, воспроизведение; синхронизация при получении токена и по расписанию (по умолчанию в 4:00).
 package main
 
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -25,36 +32,55 @@ var Version = "dev"
 // videoPlayerCmd — имя плеера после runStartupChecks: "mplayer" или "mpv"
 var videoPlayerCmd string
 
-// HTTP-клиент без проверки TLS (для загрузки с любых источников).
-var httpClient = &http.Client{
-	Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	},
-}
+// httpClient — общий HTTP-клиент; настройки TLS из конфига подставляет newHTTPClient при запуске.
+var httpClient = &http.Client{}
 
 const (
 	checkInPath = "/device/check-in"
 	mediaPath   = "/device/me/media"
-	jwtFile     = ".jwt"
+	jwtFile     = "jwt" // в STATE_DIR
 	mediaDir    = "./media"
-)
 
-type config struct {
-	ServerURL string
-	MediaDir  string
-}
+	// checkInChallengePath выдаёт nonce, который устройство подписывает своим ключом
+	checkInChallengePath = "/device/check-in/challenge"
+)
 
 // MediaItem — элемент ответа GET /api/device/me/media
 type MediaItem struct {
 	ID   string `json:"id"`
 	URL  string `json:"url"`
 	Name string `json:"name"`
+	// Checksum — необязательный хеш содержимого ("sha256:<hex>", "md5:<hex>" или hex); сверяется после загрузки
+	Checksum string `json:"checksum,omitempty"`
+	// Size — необязательный размер файла в байтах
+	Size int64 `json:"size,omitempty"`
+	// UpdatedAt — необязательная версия содержимого (время изменения на сервере); при смене файл качается заново
+	UpdatedAt string `json:"updatedAt,omitempty"`
+	// Order — позиция в плейлисте (по возрастанию); при равных — порядок ответа сервера
+	Order int `json:"order,omitempty"`
+	// Repeat — сколько раз подряд показать элемент за один проход плейлиста (0 и 1 — один раз)
+	Repeat int `json:"repeat,omitempty"`
+	// MaxDuration — ограничение показа в секундах (0 — до конца файла)
+	MaxDuration float64 `json:"maxDuration,omitempty"`
+	// Type — "video" (по умолчанию) или "image"
+	Type string `json:"type,omitempty"`
+	// Duration — время показа картинки в секундах (0 — IMAGE_DURATION)
+	Duration float64 `json:"duration,omitempty"`
+	// Schedule — окна показа (dayparting); пусто — элемент играет всегда
+	Schedule []scheduleWindow `json:"schedule,omitempty"`
 }
 
 func main() {
-	cfg := config{
-		ServerURL: getEnv("SERVER_URL", "https://statosphera.ru/api/media-player"),
-		MediaDir:  getEnv("MEDIA_DIR", mediaDir),
+	takeover := flag.Bool("takeover", false, "завершить уже запущенный экземпляр (SIGTERM) и работать вместо него")
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		exit(err)
+	}
+	setupLogger(cfg.LogFormat, cfg.LogLevel)
+	if httpClient, err = newHTTPClient(cfg); err != nil {
+		exit(err)
 	}
 	if err := os.MkdirAll(cfg.MediaDir, 0755); err != nil {
 		exit(err)
@@ -65,251 +91,515 @@ func main() {
 		exit(err)
 	}
 	cfg.MediaDir = absMediaDir
+	if err := initStateDir(cfg.StateDir); err != nil {
+		exit(err)
+	}
+	// Второй экземпляр дрался бы с первым за экран, звук и MEDIA_DIR, поэтому блокировка — до того,
+	// как трогать файлы состояния: перенос из старых мест и чистку логов
+	releaseLock, err := acquireInstanceLock(*takeover)
+	if err != nil {
+		exit(err)
+	}
+	defer releaseLock()
+	if err := migrateState(cfg.MediaDir); err != nil {
+		exit(err)
+	}
+	logLimits.Store(&cfg.Logs)
+	downloadLimiter.setPolicy(cfg.DownloadRate)
+	pruneLogs(logDir())
 
-	mac := macAddressString()
-	fmt.Printf("[mediaplayer] запуск, MAC=%s, SERVER=%s, MEDIA_DIR=%s\n", mac, cfg.ServerURL, cfg.MediaDir)
-
-	// Логирование состояния системы каждые 5 минут
-	systemLogFile := filepath.Join(cfg.MediaDir, ".system.log")
+	// SIGTERM/SIGINT — штатное завершение: отменяем загрузки, останавливаем плеер, выходим с кодом 0.
+	// SIGHUP — перечитать настройки.
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	reload := make(chan struct{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	go func() {
-		ticker := time.NewTicker(2 * time.Minute)
-		defer ticker.Stop()
-		logSystemState(systemLogFile) // сразу при старте
-		for range ticker.C {
-			logSystemState(systemLogFile)
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			logMain.Info("получен сигнал, завершаю работу", "signal", sig.String())
+			signal.Reset(syscall.SIGTERM, syscall.SIGINT) // повторный сигнал завершит процесс сразу
+			shutdown()
+			return
 		}
 	}()
 
+	mac := deviceID(cfg.DeviceIDSource, cfg.DeviceInterface)
+	deviceKey, err := loadDeviceKey()
+	if err != nil {
+		exit(fmt.Errorf("ключ устройства: %w", err))
+	}
+	logMain.Info("запуск", "version", Version, "device_id", mac, "key", keyFingerprint(deviceKey.Public().(ed25519.PublicKey)),
+		"server", cfg.ServerURL, "media_dir", cfg.MediaDir, "state_dir", stateDir)
+
+	pl := &player{logDir: logDir()}
+
+	mediaRoot := cfg.MediaDir // cfg меняется по SIGHUP, MEDIA_DIR — нет
+	collect := func() telemetry { return collectTelemetry(mediaRoot, pl.stats()) }
+
+	// Логирование состояния системы каждые 2 минуты
+	if systemLog, err := openLog(filepath.Join(logDir(), "system.log")); err == nil {
+		go func() {
+			ticker := time.NewTicker(2 * time.Minute)
+			defer ticker.Stop()
+			logSystemState(systemLog, collect()) // сразу при старте
+			for range ticker.C {
+				logSystemState(systemLog, collect())
+			}
+		}()
+	} else {
+		logState.Error("system.log не открывается", "err", err)
+	}
+
 	runStartupChecks()
 
-	// 1. Чек-ин каждые 10 минут (при 401 не выходим, продолжаем ждать)
+	// 1. Чек-ин каждые CHECKIN_INTERVAL (при 401 не выходим, продолжаем ждать) и заранее перед истечением JWT.
+	// au.checkedIn будит основной цикл, чтобы синхронизироваться сразу после получения токена.
+	au := newAuth(ctx, cfg.ServerURL, mac, deviceKey)
+	checkInEvery := make(chan time.Duration, 1) // новый CHECKIN_INTERVAL после SIGHUP
 	go func() {
-		ticker := time.NewTicker(10 * time.Minute)
+		interval := cfg.CheckInInterval
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
+		refresh := time.NewTimer(time.Hour)
+		stopTimer(refresh)
 		doCheckIn := func() {
-			jwt, err := checkIn(cfg.ServerURL, mac)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "[mediaplayer] check-in: %v\n", err)
-				return
+			if _, err := au.checkIn(); err != nil {
+				logAuth.Error("чек-ин не удался", "err", err)
 			}
-			if jwt != "" {
-				if err := saveJWT(jwt); err != nil {
-					fmt.Fprintf(os.Stderr, "[mediaplayer] save JWT: %v\n", err)
-				} else {
-					fmt.Println("[mediaplayer] check-in OK, token saved")
-				}
-			} else {
-				fmt.Println("[mediaplayer] устройство ожидает назначения группы (401)")
+			// токен истечёт раньше следующего тика — обновим его отдельно
+			stopTimer(refresh)
+			if d, ok := au.refreshIn(time.Now()); ok && d < interval {
+				refresh.Reset(max(d, 30*time.Second))
 			}
 		}
 		doCheckIn()
-		for range ticker.C {
+		for {
+			select {
+			case <-ticker.C:
+			case <-refresh.C:
+			case interval = <-checkInEvery:
+				ticker.Reset(interval)
+				continue
+			case <-ctx.Done():
+				return
+			}
 			doCheckIn()
 		}
 	}()
 
-	// 2. Синхронизация медиа при первом JWT и в 4:00; воспроизведение после загрузки
-	var mplayerMu sync.Mutex
-	var mplayerCmd *exec.Cmd
-	var ffmpegCmd *exec.Cmd
-	var playCancel context.CancelFunc
+	// Отчёт о показах (proof-of-play): очередь STATE_DIR/play-events.jsonl отправляется на сервер пачками
+	go runPlayEventsUpload(ctx, au)
+
+	// Телеметрия для панели мониторинга парка: температура, память, диск, сеть, состояние плеера
+	if cfg.HeartbeatInterval > 0 {
+		go runHeartbeat(ctx, au, cfg.HeartbeatInterval, collect)
+	}
+
+	// 2. Синхронизация медиа при первом JWT и по расписанию (SYNC_TIMES, SYNC_INTERVAL). Во время синхронизации продолжает играть
+	// текущий плейлист; новый подменяет его только после загрузки всех файлов.
 	initialSyncDone := false
-	lastRunDate := ""
+	var nextSync time.Time // следующая плановая синхронизация (настенное время)
 
-	stopPlayback := func() {
-		if playCancel != nil {
-			playCancel()
-			playCancel = nil
+	// switching — плеер переключает кто-то один: основной цикл (расписание, команды) или синхронизация,
+	// которая идёт в своей горутине
+	var switching sync.Mutex
+
+	// playCached запускает последний рабочий плейлист из манифеста (или всё, что лежит в MEDIA_DIR),
+	// если сейчас ничего не играет. Так устройство показывает контент без сети и без JWT.
+	playCached := func() {
+		switching.Lock()
+		defer switching.Unlock()
+		if pl.running() {
+			return
 		}
-		mplayerMu.Lock()
-		if mplayerCmd != nil && mplayerCmd.Process != nil {
-			_ = mplayerCmd.Process.Kill()
-			mplayerCmd = nil
+		var entries []playlistEntry
+		if m := loadManifest(); len(m.Playlist) > 0 {
+			entries = m.playlistEntries(mediaRoot, time.Now())
+		} else {
+			entries = filesPlaylist(listMediaFiles(mediaRoot))
 		}
-		if ffmpegCmd != nil && ffmpegCmd.Process != nil {
-			_ = ffmpegCmd.Process.Kill()
-			ffmpegCmd = nil
+		if len(entries) == 0 {
+			return
 		}
-		mplayerMu.Unlock()
-		clearDisplayBlack() // сразу чёрный экран, чтобы не мелькала консоль
+		logPlayer.Info("играю локальную библиотеку", "items", len(entries))
+		pl.play(entries)
 	}
 
-	syncAndPlay := func() {
-		jwt, _ := loadJWT()
-		if jwt == "" {
+	// applySchedule переключает плейлист, когда по расписанию должен играть другой набор элементов.
+	// Работает по манифесту на диске, поэтому не зависит от сети.
+	applySchedule := func() {
+		switching.Lock()
+		defer switching.Unlock()
+		m := loadManifest()
+		if len(m.Playlist) == 0 {
 			return
 		}
-		fmt.Println("[mediaplayer] JWT есть, запрашиваю медиа...")
-		stopPlayback()
-		items, err := fetchMedia(cfg.ServerURL, jwt)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "[mediaplayer] fetch media: %v\n", err)
+		entries := m.playlistEntries(mediaRoot, time.Now())
+		if pl.playingEntries(entries) {
 			return
 		}
-		fmt.Printf("[mediaplayer] медиа с сервера: %d шт.\n", len(items))
-		if len(items) == 0 {
-			fmt.Println("[mediaplayer] список пуст, воспроизведение не запускаю")
+		if len(entries) == 0 {
+			if pl.running() {
+				logPlayer.Info("расписание: сейчас показывать нечего, останавливаю воспроизведение")
+				pl.stop()
+			}
+			return
+		}
+		logPlayer.Info("расписание: переключаю плейлист", "items", len(entries))
+		pl.play(entries)
+	}
+
+	// dropEvicted убирает из играющего плейлиста файлы, удалённые ради места под новый: без этого плеер
+	// спотыкался бы о них до конца загрузки, а при частичной загрузке — до следующей синхронизации.
+	// Плейлист берётся из манифеста на диске: его, в отличие от манифеста загрузки, никто не меняет.
+	dropEvicted := func() {
+		switching.Lock()
+		defer switching.Unlock()
+		if !pl.running() {
+			return
+		}
+		var entries []playlistEntry
+		if m := loadManifest(); len(m.Playlist) > 0 {
+			entries = m.playlistEntries(mediaRoot, time.Now())
+		} else {
+			entries = filesPlaylist(listMediaFiles(mediaRoot))
+		}
+		if pl.playingEntries(entries) {
 			return
 		}
+		logPlayer.Info("файлы текущего плейлиста удалены ради нового, играю оставшиеся", "items", len(entries))
+		pl.play(entries) // пустой — останавливает, и синхронизация запустит то, что успело загрузиться
+	}
+
+	// syncAndPlay синхронизирует медиа и сообщает, чем кончилось. Работает в своей горутине
+	// с копией настроек sc: основной цикл тем временем может перечитать cfg по SIGHUP.
+	syncAndPlay := func(sc config) syncOutcome {
+		if au.token() == "" {
+			return syncFailed
+		}
+		logSync.Info("запрашиваю список медиа")
+		var items []MediaItem
+		err := au.do(func(jwt string) (err error) {
+			items, err = fetchMedia(ctx, sc.ServerURL, jwt)
+			return err
+		})
+		if ctx.Err() != nil {
+			return syncFailed
+		}
+		if err != nil {
+			var se *statusError
+			if errors.As(err, &se) {
+				logSync.Error("список медиа не получен", "status", se.Code, "err", err)
+			} else {
+				logSync.Error("список медиа не получен", "err", err)
+			}
+			playCached()
+			return syncFailed
+		}
+		logSync.Info("список медиа получен", "items", len(items))
+		manifest := loadManifest()
+		if len(items) == 0 {
+			logSync.Info("список пуст, воспроизведение останавливаю")
+			switching.Lock()
+			defer switching.Unlock()
+			pl.stop()
+			cleanupByIDs(mediaRoot, map[string]bool{})
+			manifest.prune(map[string]bool{})
+			manifest.setPlaylist(nil)
+			if err := manifest.save(); err != nil {
+				logSync.Error("манифест не сохранён", "err", err)
+			}
+			return syncComplete
+		}
 		keepIDs := make(map[string]bool)
+		want := 0
 		for _, it := range items {
 			keepIDs[fileID(it.ID)] = true
+			if it.URL != "" {
+				want++
+			}
 		}
-		cleanupByIDs(cfg.MediaDir, keepIDs)
-		fmt.Println("[mediaplayer] скачиваю файлы...")
-		downloaded, err := downloadMedia(cfg.MediaDir, items)
+		logSync.Info("скачиваю файлы")
+		ready, err := downloadMedia(ctx, mediaRoot, manifest, items, sc.DownloadConcurrency, sc.MinFreeSpace, dropEvicted)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "[mediaplayer] download: %v\n", err)
+			logSync.Error("загрузка прервана", "err", err)
 		}
-		fmt.Printf("[mediaplayer] скачано: %d из %d\n", len(downloaded), len(items))
-		if len(downloaded) == 0 {
-			fmt.Println("[mediaplayer] ни одного файла не загрузилось, воспроизведение не запускаю")
-			return
+		if ctx.Err() != nil {
+			return syncFailed // завершаемся — плейлист не трогаем
 		}
-		fmt.Printf("[mediaplayer] запускаю воспроизведение (%s плейлист, vo=%s)\n", videoPlayerCmd, mplayerVideoOutput())
-		setDisplayResolution1280x720() // 1280x720 перед воспроизведением (X11)
-		clearDisplayBlack()            // чёрный до первого кадра
-		ctx, cancel := context.WithCancel(context.Background())
-		playCancel = cancel
-		go func() {
-			defer cancel()
-			select {
-			case <-ctx.Done():
-				return
+		logSync.Info("загрузка завершена", "ready", len(ready), "total", want)
+		outcome := syncComplete
+		if len(ready) < want {
+			outcome = syncPartial
+		}
+		if len(ready) < want && pl.running() {
+			logSync.Warn("загружено не всё, оставляю текущий плейлист до следующей попытки", "retry_in", syncRetryDelay.String())
+			return outcome
+		}
+		if len(ready) == 0 {
+			logSync.Warn("ни одного файла не загрузилось, играю то, что есть на диске")
+			playCached()
+			return outcome
+		}
+		// манифест на диске и плеер меняем вместе, чтобы applySchedule не вернул старый плейлист
+		switching.Lock()
+		defer switching.Unlock()
+		manifest.setPlaylist(ready)
+		manifest.prune(keepIDs)
+		if err := manifest.save(); err != nil {
+			logSync.Error("манифест не сохранён", "err", err)
+		}
+		entries := manifest.playlistEntries(mediaRoot, time.Now())
+		if pl.playingEntries(entries) {
+			logSync.Info("плейлист не изменился, воспроизведение не перезапускаю")
+			cleanupByIDs(mediaRoot, keepIDs)
+			manifest.removeStale(mediaRoot)
+			return outcome
+		}
+		// старые файлы удаляем только после того, как плеер переключился на новый плейлист
+		pl.play(entries)
+		cleanupByIDs(mediaRoot, keepIDs)
+		manifest.removeStale(mediaRoot)
+		return outcome
+	}
+
+	// Офлайн-старт: сразу играем последний рабочий плейлист, не дожидаясь чек-ина и сети
+	playCached()
+
+	// 3. Канал команд с сервера: синхронизация и перезапуск плеера выполняются в основном цикле,
+	// остальные команды — сразу.
+	control := make(chan string, 4)
+	if cfg.PushEnabled {
+		go runPushChannel(ctx, au, func(cmd pushCommand) {
+			switch cmd.Command {
+			case cmdSync, cmdRestartPlayer:
+				select {
+				case control <- cmd.Command:
+				default:
+				}
+			case cmdReboot:
+				rebootDevice()
+			case cmdVolume:
+				if vol, ok := setVolume(cmd.Value); ok {
+					_ = pl.setVolume(vol) // у mplayer громкость применится при следующем запуске
+				}
+			case cmdNext:
+				if err := pl.next(); err != nil {
+					logPush.Warn("команда не выполнена", "command", cmd.Command, "err", err)
+				}
+			case cmdPause, cmdResume:
+				if err := pl.setPaused(cmd.Command == cmdPause); err != nil {
+					logPush.Warn("команда не выполнена", "command", cmd.Command, "err", err)
+				}
+			case cmdScreenshot:
+				go func() {
+					if err := takeScreenshot(au); err != nil {
+						logPush.Error("скриншот не отправлен", "err", err)
+					}
+				}()
 			default:
+				logPush.Warn("неизвестная команда", "command", cmd.Command)
 			}
-			mplayerMu.Lock()
-			ffmpegCmd, mplayerCmd = runConcatPlayback(cfg.MediaDir)
-			mplayerMu.Unlock()
-			if mplayerCmd == nil {
-				return
-			}
-			_ = mplayerCmd.Wait()
-			mplayerMu.Lock()
-			if ffmpegCmd != nil && ffmpegCmd.Process != nil {
-				_ = ffmpegCmd.Process.Kill()
-			}
-			ffmpegCmd, mplayerCmd = nil, nil
-			mplayerMu.Unlock()
-		}()
+		})
+	}
+
+	// Тикаем на границе минуты, чтобы расписание переключало плейлисты вовремя
+	tick := time.NewTimer(time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)))
+	defer tick.Stop()
+	// syncTimer срабатывает к nextSync; у каждого устройства свой сдвиг SYNC_JITTER, чтобы не ходить на сервер одновременно
+	syncTimer := time.NewTimer(time.Hour)
+	stopTimer(syncTimer)
+	defer syncTimer.Stop()
+	planSync := func(last time.Time) {
+		nextSync = cfg.nextSyncTime(time.Now(), last)
+		stopTimer(syncTimer)
+		if nextSync.IsZero() {
+			return
+		}
+		syncTimer.Reset(time.Until(nextSync))
+		logSync.Info("следующая синхронизация", "at", nextSync.Format("2006-01-02 15:04:05"))
 	}
 
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+	// Синхронизация идёт в своей горутине: загрузка может длиться часами (DOWNLOAD_RATE_LIMIT), а расписание,
+	// SIGHUP и команды сервера должны срабатывать вовремя. Итог приходит в syncDone.
+	syncDone := make(chan syncOutcome)
+	syncing := false
+	startSync := func() {
+		syncing = true
+		sc := cfg
+		go func() { syncDone <- syncAndPlay(sc) }()
+	}
 
-	// Первую проверку делаем сразу (чтобы не ждать минуту после check-in), дальше — по тикеру
+	// Первую проверку делаем сразу, дальше — каждую минуту, по syncTimer или сразу после успешного чек-ина
 	for first := true; ; first = false {
+		scheduled := false
 		if !first {
-			<-ticker.C
-		}
-		jwt, _ := loadJWT()
-		if jwt == "" {
-			if first {
-				time.Sleep(2 * time.Second) // дать чек-ину успеть сохранить токен
-				jwt, _ = loadJWT()
-			}
-			if jwt == "" {
+			select {
+			case <-tick.C:
+				tick.Reset(time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)))
+				// часы могли перескочить (NTP после загрузки) — сверяемся с настенным временем
+				scheduled = !nextSync.IsZero() && !time.Now().Before(nextSync)
+			case <-syncTimer.C:
+				scheduled = true
+			case <-au.checkedIn:
+			case <-ctx.Done():
+			case <-reload:
+				cfg = reloadConfig(cfg)
+				logLimits.Store(&cfg.Logs)
+				logLevel.Set(cfg.LogLevel)
+				downloadLimiter.setPolicy(cfg.DownloadRate)
+				select {
+				case <-checkInEvery: // прошлое значение ещё не забрали — заменяем
+				default:
+				}
+				checkInEvery <- cfg.CheckInInterval
+				if initialSyncDone {
+					planSync(time.Now())
+				}
+			case cmd := <-control:
+				switch cmd {
+				case cmdSync:
+					scheduled = true
+				case cmdRestartPlayer:
+					logPlayer.Info("перезапуск плеера по команде сервера")
+					switching.Lock()
+					pl.stop()
+					switching.Unlock()
+					playCached()
+				}
+			case outcome := <-syncDone:
+				syncing = false
+				if outcome != syncFailed {
+					initialSyncDone = true
+				}
+				switch {
+				case outcome == syncComplete:
+					planSync(time.Now())
+				case initialSyncDone:
+					// сервер недоступен или скачано не всё — повторим чуть позже, а не в следующее плановое время:
+					// иначе один сбой связи откладывал бы новый плейлист до завтрашней синхронизации
+					nextSync = time.Now().Add(syncRetryDelay).Round(0)
+					stopTimer(syncTimer)
+					syncTimer.Reset(syncRetryDelay)
+				}
+				// пока сервер не ответил ни разу, следующая попытка — на следующем шаге цикла
 				continue
 			}
 		}
-		now := time.Now()
-		is4AM := now.Hour() == 4 && now.Minute() == 0
-		today := now.Format("2006-01-02")
+		if ctx.Err() != nil {
+			break
+		}
+		applySchedule()
+		if syncing || au.token() == "" {
+			continue // идущая синхронизация заодно выполнит и запрошенную
+		}
 
 		if !initialSyncDone {
-			initialSyncDone = true
-			fmt.Println("[mediaplayer] первый запуск с токеном — синхронизация медиа")
-			syncAndPlay()
+			// пока сервер не ответил ни разу, пробуем на каждом шаге; до этого играет кэш
+			logSync.Info("первый запуск с токеном — синхронизация медиа")
+			startSync()
 			continue
 		}
-		if is4AM && today != lastRunDate {
-			lastRunDate = today
-			fmt.Println("[mediaplayer] 4:00 — синхронизация медиа")
-			syncAndPlay()
+		if scheduled {
+			logSync.Info("синхронизация медиа")
+			startSync()
 		}
 	}
+
+	// Штатное завершение: загрузки уже отменены через ctx, дожидаемся синхронизации, останавливаем плеер и гасим экран
+	if syncing {
+		<-syncDone
+	}
+	pl.stop()
+	logMain.Info("остановлен")
+	_ = os.Stdout.Sync()
+	_ = os.Stderr.Sync()
 }
 
-// logSystemState записывает состояние системы (CPU, память, температура) в лог
-func logSystemState(logFile string) {
-	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return
+// stopTimer останавливает таймер и вычитывает уже сработавшее значение, чтобы Reset не дал лишний тик.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
 	}
-	defer f.Close()
+}
+
+// syncRetryDelay — через сколько повторить синхронизацию, если сервер не ответил или скачано не всё.
+const syncRetryDelay = 5 * time.Minute
 
-	now := time.Now().Format("2006-01-02 15:04:05")
+// syncOutcome — чем кончилась синхронизация медиа.
+type syncOutcome int
+
+const (
+	syncFailed   syncOutcome = iota // список медиа не получен
+	syncPartial                     // список получен, но часть файлов не скачана
+	syncComplete                    // всё скачано
+)
+
+// logSystemState записывает состояние системы (температура, CPU, память, диск, сеть) и плеера в лог
+func logSystemState(w io.Writer, t telemetry) {
+	now := t.Time.Local().Format("2006-01-02 15:04:05")
 	var logLines []string
 
 	// Температура
-	if tempData, err := os.ReadFile("/sys/class/thermal/thermal_zone0/temp"); err == nil {
-		var temp int
-		if _, err := fmt.Sscanf(strings.TrimSpace(string(tempData)), "%d", &temp); err == nil {
-			logLines = append(logLines, fmt.Sprintf("[%s] Temp: %.1f°C", now, float64(temp)/1000))
-		}
+	if t.Temperature != nil {
+		logLines = append(logLines, fmt.Sprintf("[%s] Temp: %.1f°C", now, *t.Temperature))
 	}
 
 	// Загрузка CPU
-	if loadData, err := os.ReadFile("/proc/loadavg"); err == nil {
-		fields := strings.Fields(string(loadData))
-		if len(fields) >= 3 {
-			logLines = append(logLines, fmt.Sprintf("[%s] Load: %s %s %s", now, fields[0], fields[1], fields[2]))
-		}
+	if len(t.Load) == 3 {
+		logLines = append(logLines, fmt.Sprintf("[%s] Load: %.2f %.2f %.2f", now, t.Load[0], t.Load[1], t.Load[2]))
 	}
 
 	// Память
-	if memData, err := os.ReadFile("/proc/meminfo"); err == nil {
-		memLines := strings.Split(string(memData), "\n")
-		var memTotal, memFree, memAvailable int
-		for _, line := range memLines {
-			if strings.HasPrefix(line, "MemTotal:") {
-				fmt.Sscanf(line, "MemTotal: %d", &memTotal)
-			}
-			if strings.HasPrefix(line, "MemFree:") {
-				fmt.Sscanf(line, "MemFree: %d", &memFree)
-			}
-			if strings.HasPrefix(line, "MemAvailable:") {
-				fmt.Sscanf(line, "MemAvailable: %d", &memAvailable)
-			}
-		}
-		if memTotal > 0 {
-			memUsed := memTotal - memAvailable
-			memPercent := float64(memUsed) / float64(memTotal) * 100
-			logLines = append(logLines, fmt.Sprintf("[%s] RAM: %dMB/%dMB (%.1f%%)", now, memUsed/1024, memTotal/1024, memPercent))
-		}
+	if t.MemTotalMB > 0 {
+		memUsed := t.MemTotalMB - t.MemAvailMB
+		memPercent := float64(memUsed) / float64(t.MemTotalMB) * 100
+		logLines = append(logLines, fmt.Sprintf("[%s] RAM: %dMB/%dMB (%.1f%%)", now, memUsed, t.MemTotalMB, memPercent))
 	}
 
-	// Записываем все строки
-	for _, line := range logLines {
-		f.WriteString(line + "\n")
+	// Диск MEDIA_DIR и сеть
+	if t.DiskTotalMB > 0 {
+		logLines = append(logLines, fmt.Sprintf("[%s] Disk: %dMB free of %dMB", now, t.DiskFreeMB, t.DiskTotalMB))
 	}
-}
-
-// macAddressString возвращает MAC первого не-loopback интерфейса в формате "AA:BB:CC:DD:EE:FF".
-func macAddressString() string {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return ""
-	}
-	for _, iface := range interfaces {
-		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) < 6 {
-			continue
-		}
-		a := iface.HardwareAddr
-		return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", a[0], a[1], a[2], a[3], a[4], a[5])
+	if t.Storage != nil && t.Storage.Full {
+		logLines = append(logLines, fmt.Sprintf("[%s] Disk full: %d files not downloaded, %dMB short", now, t.Storage.Skipped, t.Storage.RequiredMB))
 	}
-	return ""
+	logLines = append(logLines, fmt.Sprintf("[%s] Net: %s %s, uptime %s", now, t.Network.Type, t.Network.Interface, time.Duration(t.Uptime)*time.Second))
+
+	// Плеер: состояние, падения, перезапуски супервизором, файлы в карантине
+	ps := t.Player
+	logLines = append(logLines, fmt.Sprintf("[%s] Player: %s %s, crashes %d, restarts %d, quarantined %d", now, ps.State, ps.Current, ps.Crashes, ps.Restarts, ps.Quarantined))
+
+	// Записываем все строки одной записью, чтобы ротация не разрезала замер
+	io.WriteString(w, strings.Join(logLines, "\n")+"\n")
 }
 
+// getEnv возвращает настройку из окружения или файла настроек (без "/" в конце), иначе def.
 func getEnv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
+	if v := configValue(key); v != "" {
 		return strings.TrimRight(v, "/")
 	}
 	return def
 }
 
 func loadJWT() (string, error) {
-	b, err := os.ReadFile(jwtFile)
+	unlock, err := lockState(false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	b, err := os.ReadFile(statePath(jwtFile))
 	if err != nil {
 		return "", err
 	}
@@ -317,49 +607,110 @@ func loadJWT() (string, error) {
 }
 
 func saveJWT(token string) error {
-	return os.WriteFile(jwtFile, []byte(token), 0600)
+	unlock, err := lockState(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(statePath(jwtFile), []byte(token), 0600)
+}
+
+func removeJWT() error {
+	unlock, err := lockState(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(statePath(jwtFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
 }
 
 type checkInReq struct {
 	MACAddress string `json:"macAddress"`
+	PublicKey  string `json:"publicKey,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+	// Storage — итог проверки места (как в телеметрии): без HEARTBEAT_INTERVAL сервер узнаёт о нехватке из чек-ина
+	Storage *diskState `json:"storage,omitempty"`
 }
 
 type checkInResp struct {
 	AccessToken string `json:"accessToken"`
 }
 
-func checkIn(serverURL, macAddress string) (jwt string, err error) {
+type challengeResp struct {
+	Nonce string `json:"nonce"`
+}
+
+// checkIn получает JWT: запрашивает у сервера nonce, подписывает его ключом устройства и отправляет
+// вместе с открытым ключом. Пустой токен без ошибки — 401, устройство ждёт назначения группы;
+// errEnrollmentPending — 202, ключ ещё не подтверждён администратором.
+func checkIn(ctx context.Context, serverURL, macAddress string, key ed25519.PrivateKey) (jwt string, err error) {
 	if macAddress == "" {
-		return "", fmt.Errorf("mac address not found")
+		return "", fmt.Errorf("device id not found")
 	}
-	body, _ := json.Marshal(checkInReq{MACAddress: macAddress})
-	req, err := http.NewRequest(http.MethodPost, serverURL+checkInPath, bytes.NewReader(body))
-	if err != nil {
+	in := checkInReq{MACAddress: macAddress, PublicKey: publicKeyString(key)}
+	var ch challengeResp
+	status, err := postJSON(ctx, serverURL+checkInChallengePath, in, &ch)
+	switch {
+	case err != nil:
+		return "", err
+	case status == http.StatusNotFound:
+		// сервер без подписи устройств: чек-ин по MAC, открытый ключ всё равно передаём для регистрации
+		logAuth.Warn("сервер не выдаёт nonce — чек-ин без подписи", "path", checkInChallengePath)
+	case status != http.StatusOK || ch.Nonce == "":
+		return "", fmt.Errorf("check-in challenge %d: нет nonce", status)
+	default:
+		in.Nonce, in.Signature = ch.Nonce, signCheckIn(key, ch.Nonce, macAddress)
+	}
+	in.Storage = diskStatus.Load()
+	var out checkInResp
+	status, err = postJSON(ctx, serverURL+checkInPath, in, &out)
+	switch {
+	case err != nil:
 		return "", err
+	case status == http.StatusUnauthorized:
+		return "", nil
+	case status == http.StatusAccepted:
+		return "", errEnrollmentPending
+	case status != http.StatusOK && status != http.StatusCreated:
+		return "", fmt.Errorf("check-in %d", status)
+	}
+	return out.AccessToken, nil
+}
+
+// postJSON отправляет body в формате JSON и при ответе 200/201 разбирает ответ в out.
+// Прочие коды возвращаются без ошибки; тело ответа с кодом 4xx/5xx попадает в лог.
+func postJSON(ctx context.Context, url string, body, out any) (int, error) {
+	b, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusUnauthorized {
-		return "", nil
-	}
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		bs, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("check-in %d: %s", resp.StatusCode, string(bs))
-	}
-	var out checkInResp
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return "", err
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	case resp.StatusCode >= 400 && resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusNotFound:
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		logAuth.Warn("ошибка сервера", "url", url, "status", resp.StatusCode, "body", string(bs))
 	}
-	return out.AccessToken, nil
+	return resp.StatusCode, nil
 }
 
-func fetchMedia(serverURL, jwt string) ([]MediaItem, error) {
-	req, err := http.NewRequest(http.MethodGet, serverURL+mediaPath, nil)
+func fetchMedia(ctx context.Context, serverURL, jwt string) ([]MediaItem, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+mediaPath, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -371,17 +722,49 @@ func fetchMedia(serverURL, jwt string) ([]MediaItem, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusUnauthorized {
-		return nil, fmt.Errorf("401: токен невалиден")
+		return nil, errUnauthorized
 	}
 	if resp.StatusCode != http.StatusOK {
-		bs, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("media %d: %s", resp.StatusCode, string(bs))
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &statusError{Code: resp.StatusCode, Body: string(bs)}
 	}
-	var items []MediaItem
-	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+	return decodeMedia(resp.Body)
+}
+
+// statusError — сервер ответил на запрос списка медиа неожиданным кодом; Code пишется в лог отдельным полем.
+type statusError struct {
+	Code int
+	Body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("media %d: %s", e.Code, e.Body)
+}
+
+// decodeMedia разбирает ответ GET /device/me/media: массив элементов или объект
+// { "items": [...], "playlists": [{ "schedule": [...], "items": [...] }] }. Окна расписания
+// с ошибками отбрасываются (см. validSchedules).
+func decodeMedia(r io.Reader) ([]MediaItem, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		var items []MediaItem
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, err
+		}
+		return validSchedules(items), nil
+	}
+	var out struct {
+		Items     []MediaItem     `json:"items"`
+		Playlists []mediaPlaylist `json:"playlists"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
 		return nil, err
 	}
-	return items, nil
+	return validSchedules(append(out.Items, flattenPlaylists(out.Playlists)...)), nil
 }
 
 // fileID делает безопасное имя файла из id (подписываем как в ссылках).
@@ -401,55 +784,463 @@ func fileID(id string) string {
 	return s
 }
 
-func downloadMedia(dir string, items []MediaItem) (downloaded []string, err error) {
+// downloadMedia скачивает items в dir, пропуская файлы, которые по манифесту не изменились;
+// одновременно качается не больше concurrency файлов. Возвращает элементы, файлы которых есть
+// на диске, в исходном порядке. Перед загрузкой проверяет место: при нехватке удаляет файлы не из
+// нового плейлиста (и вызывает evicted — среди них могут быть файлы играющего плейлиста; вызов всегда
+// из горутины downloadMedia), а файлы, которые всё равно не помещаются с запасом minFree, не качает.
+func downloadMedia(ctx context.Context, dir string, manifest *mediaManifest, items []MediaItem, concurrency int, minFree int64, evicted func()) (ready []MediaItem, err error) {
+	keepIDs := make(map[string]bool)
 	for _, it := range items {
-		if it.URL == "" {
-			continue
+		keepIDs[fileID(it.ID)] = true
+	}
+	// записи текущего плейлиста остаются, пока он играет (и с него же офлайн-старт): если загрузится
+	// не всё, он продолжит играть целиком. Лишнее убирает syncAndPlay после setPlaylist.
+	keepManifest := make(map[string]bool, len(keepIDs))
+	for id := range keepIDs {
+		keepManifest[id] = true
+	}
+	for _, it := range manifest.Playlist {
+		keepManifest[fileID(it.ID)] = true
+	}
+	manifest.prune(keepManifest)
+
+	// один файл на id: повторы в плейлисте качать параллельно в тот же .part нельзя
+	var jobs []MediaItem
+	seen := make(map[string]bool)
+	for _, it := range items {
+		if it.URL != "" && !seen[fileID(it.ID)] {
+			seen[fileID(it.ID)] = true
+			jobs = append(jobs, it)
+		}
+	}
+	// сколько ещё скачать: fileID → байт, -1 — размер неизвестен (его узнаёт HEAD в загрузчике).
+	// Для проверки места хватает размеров из плейлиста, поэтому HEAD-запросы не задерживают загрузку
+	var mu sync.Mutex // manifest, done, budget, счётчики места
+	need := make(map[string]int64)
+	var required int64
+	for _, it := range jobs {
+		if _, ok := manifest.upToDate(dir, it); !ok {
+			n := downloadSize(it, it.Size, filepath.Join(dir, fileID(it.ID)+".part"))
+			need[fileID(it.ID)] = n
+			required += max(n, 0)
+		}
+	}
+	budget := int64(-1) // сколько можно занять, не залезая в minFree; -1 — неизвестно, не ограничиваем
+	avail := int64(-1)  // budget до распределения: с ним сравниваем required, чтобы узнать нехватку
+	if free, err := freeSpace(dir); err == nil && len(need) > 0 {
+		if required+minFree > free && evictStale(dir, keepIDs, required+minFree-free) > 0 {
+			evicted()
+			// место освобождается, только когда плеер закроет удалённый файл, поэтому перечитываем
+			free, _ = freeSpace(dir)
+		}
+		budget = max(free-minFree, 0)
+		avail = budget
+	}
+	// reserve списывает место под it перед загрузкой; false — файл не помещается и не качается.
+	// Место достаётся файлам в порядке очереди, то есть (почти) в порядке плейлиста: первые элементы важнее
+	skipped := 0
+	evictedLate := false // загрузчики удаляли файлы; evicted вызываем один раз, после загрузки
+	reserve := func(it MediaItem) bool {
+		n, ok := need[fileID(it.ID)]
+		if !ok {
+			return true
+		}
+		mu.Lock()
+		limited := budget >= 0
+		mu.Unlock()
+		if !limited {
+			return true
+		}
+		headed := n < 0
+		if headed {
+			n = downloadSize(it, headContentLength(ctx, it.URL), filepath.Join(dir, fileID(it.ID)+".part"))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if headed {
+			required += max(n, 0) // известные размеры уже учтены выше
+		}
+		if n > budget {
+			// размер стал известен только сейчас — освобождаем место так же, как перед загрузкой
+			freed := evictStale(dir, keepIDs, n-budget)
+			budget += freed
+			avail += freed
+			evictedLate = evictedLate || freed > 0
+		}
+		fits := n <= budget && (n >= 0 || budget > 0)
+		if fits {
+			budget -= max(n, 0)
+		} else {
+			logSync.Error("не хватает места, файл не скачиваю", "media_id", it.ID, "url", it.URL,
+				"need_kb", n>>10, "free_kb", budget>>10, "min_free_kb", minFree>>10)
+			skipped++
+		}
+		return fits
+	}
+
+	done := make(map[string]bool)
+	diskFull := 0
+	queue := make(chan MediaItem)
+	var wg sync.WaitGroup
+	for i := 0; i < min(concurrency, len(jobs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range queue {
+				if !reserve(it) {
+					continue
+				}
+				err := syncMediaFile(ctx, dir, manifest, &mu, it)
+				mu.Lock()
+				if err == nil {
+					done[fileID(it.ID)] = true
+				} else if errors.Is(err, errDiskFull) {
+					diskFull++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, it := range jobs {
+		if ctx.Err() != nil {
+			break // завершение процесса: недокачанные .part докачаются при следующем запуске
+		}
+		queue <- it
+	}
+	close(queue)
+	wg.Wait()
+	if evictedLate {
+		evicted()
+	}
+	if ctx.Err() == nil {
+		var short int64 // сколько байт не хватает
+		if avail >= 0 {
+			short = max(required-avail, 0)
+		}
+		setDiskFull(skipped+diskFull, short)
+	}
+
+	for _, it := range items {
+		if it.URL != "" && done[fileID(it.ID)] {
+			ready = append(ready, it)
+		}
+	}
+	if err := manifest.save(); err != nil {
+		return ready, err
+	}
+	return ready, nil
+}
+
+// syncMediaFile приводит файл it на диске в актуальное состояние: оставляет неизменённый, принимает
+// совпавший по checksum или скачивает. mu защищает manifest от соседних загрузок.
+// Ошибка (уже записанная в лог) — файла нет или загрузка не удалась.
+func syncMediaFile(ctx context.Context, dir string, manifest *mediaManifest, mu *sync.Mutex, it MediaItem) error {
+	mu.Lock()
+	if path, ok := manifest.upToDate(dir, it); ok {
+		mu.Unlock()
+		logSync.Debug("без изменений", "media_id", it.ID, "name", it.Name, "file", filepath.Base(path))
+		return nil
+	}
+	path, adopted := manifest.adopt(dir, it)
+	mu.Unlock()
+	if adopted {
+		logSync.Info("уже на диске (checksum совпал)", "media_id", it.ID, "name", it.Name, "file", filepath.Base(path))
+	} else {
+		part := filepath.Join(dir, fileID(it.ID)+".part")
+		started := time.Now()
+		contentType, err := downloadFile(ctx, it, part)
+		if err != nil {
+			logSync.Error("загрузка не удалась", "media_id", it.ID, "url", it.URL, "err", err)
+			return err
+		}
+		ext := detectMediaExt(part, contentType, it.URL)
+		if ext == "" && notMediaType(contentType) {
+			// вместо файла пришла страница ошибки или входа — в плейлисте ей не место
+			_ = os.Remove(part)
+			err := fmt.Errorf("сервер вернул %s вместо медиафайла", contentType)
+			logSync.Error("загрузка не удалась", "media_id", it.ID, "url", it.URL, "content_type", contentType, "err", err)
+			return err
+		}
+		if ext == "" {
+			ext = ".mp4"
+			if it.Type == "image" {
+				ext = ".jpg"
+			}
+			logSync.Warn("формат не распознан", "media_id", it.ID, "url", it.URL, "content_type", contentType, "ext", ext)
 		}
-		ext := extFromURL(it.URL)
 		name := filepath.Join(dir, fileID(it.ID)+ext)
-		if err := downloadFile(it.URL, name); err != nil {
-			fmt.Fprintf(os.Stderr, "[mediaplayer] download %s: %v\n", it.URL, err)
-			continue
+		if err := os.Rename(part, name); err != nil {
+			logSync.Error("загрузка не удалась", "media_id", it.ID, "url", it.URL, "err", err)
+			return err
 		}
-		fmt.Printf("[mediaplayer] загружен: %s -> %s\n", it.Name, filepath.Base(name))
-		downloaded = append(downloaded, name)
+		mu.Lock()
+		err = manifest.record(name, it)
+		mu.Unlock()
+		if err != nil {
+			logSync.Error("запись в манифест не удалась", "media_id", it.ID, "err", err)
+			return err
+		}
+		logSync.Info("загружен", "media_id", it.ID, "name", it.Name, "file", filepath.Base(name), "type", mediaTypes[ext],
+			"duration", time.Since(started).Round(time.Millisecond).String())
+	}
+	// сохраняем после каждого файла, чтобы обрыв не заставил перекачивать уже скачанное
+	mu.Lock()
+	err := manifest.save()
+	mu.Unlock()
+	if err != nil {
+		logSync.Error("манифест не сохранён", "err", err)
 	}
-	return downloaded, nil
+	return nil
 }
 
-func extFromURL(url string) string {
-	u := strings.ToLower(url)
-	for _, e := range []string{".mkv", ".mp4", ".avi", ".webm"} {
-		if strings.Contains(u, e) {
-			return e
+// downloadFile скачивает it.URL во временный part: при обрыве докачивает с места остановки (Range),
+// сверяет размер (Content-Length и it.Size) и, если сервер его прислал, checksum. Size<=0 — размер неизвестен.
+// part от другой версии элемента (сменились checksum, updatedAt или URL) не докачивается, а удаляется.
+// Возвращает Content-Type ответа; переименование в итоговый файл — за вызывающим.
+func downloadFile(ctx context.Context, it MediaItem, part string) (contentType string, err error) {
+	url, size, checksum := it.URL, it.Size, it.Checksum
+	meta := loadPartMeta(part)
+	if meta.Version != itemVersion(it) {
+		if _, err := os.Stat(part); err == nil {
+			logSync.Info("недокачанный файл от прошлой версии, качаю заново", "media_id", it.ID, "file", filepath.Base(part))
+		}
+		_ = os.Remove(part)
+		meta = partMeta{Version: itemVersion(it)}
+	}
+	// общего срока нет: при DOWNLOAD_RATE_LIMIT большой файл законно качается часами; зависшее
+	// соединение обрывает downloadIdleTimeout, а попытка, которая что-то скачала, не считается
+	for attempt := 1; ; attempt++ {
+		before := fileSize(part)
+		ct, done, err := downloadPart(ctx, url, part, &meta)
+		if ct != "" {
+			contentType = ct
 		}
+		if done {
+			break
+		}
+		if fileSize(part) > before {
+			attempt = 0
+		}
+		if errors.Is(err, syscall.ENOSPC) {
+			_ = os.Remove(part) // недокачанный файл только занимает место
+			return "", fmt.Errorf("%w: %v", errDiskFull, err)
+		}
+		if attempt >= downloadAttempts || ctx.Err() != nil {
+			return "", err
+		}
+		wait := time.Duration(max(attempt, 1)) * 5 * time.Second
+		logSync.Warn("загрузка прервана, докачаю", "url", url, "err", err, "retry_in", wait.String(), "attempt", attempt)
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(wait):
+		}
+	}
+	if size > 0 {
+		if st, err := os.Stat(part); err != nil || st.Size() != size {
+			_ = os.Remove(part)
+			return "", fmt.Errorf("размер не совпал с size=%d", size)
+		}
+	}
+	if err := verifyChecksum(part, checksum); err != nil {
+		_ = os.Remove(part) // битый файл докачивать бессмысленно
+		_ = os.Remove(partMetaPath(part))
+		return "", err
+	}
+	_ = os.Remove(partMetaPath(part))
+	return contentType, nil
+}
+
+// downloadAttempts — сколько попыток подряд без единого скачанного байта делаем за один вызов downloadFile.
+const downloadAttempts = 6
+
+// downloadIdleTimeout — попытка прерывается, если столько времени с сервера не пришло ни байта.
+const downloadIdleTimeout = 2 * time.Minute
+
+// fileSize возвращает размер файла, 0 — файла нет.
+func fileSize(path string) int64 {
+	if st, err := os.Stat(path); err == nil {
+		return st.Size()
+	}
+	return 0
+}
+
+// idleReader продлевает таймер простоя при каждом полученном байте.
+type idleReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.timer.Reset(downloadIdleTimeout)
 	}
-	return ".mp4"
+	return n, err
 }
 
-func downloadFile(url, path string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+// downloadPart докачивает url в part, продолжая с текущего размера part. Докачка идёт с If-Range:
+// если файл на сервере сменился, сервер отдаст его целиком. meta запоминает ETag/Last-Modified
+// первого ответа. done=true — файл скачан полностью и его размер совпал с ожидаемым.
+func downloadPart(parent context.Context, url, part string, meta *partMeta) (contentType string, done bool, err error) {
+	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
+	idle := time.AfterFunc(downloadIdleTimeout, cancel)
+	defer idle.Stop()
+	defer func() {
+		if err != nil && ctx.Err() != nil && parent.Err() == nil {
+			err = fmt.Errorf("нет данных от сервера %s", downloadIdleTimeout)
+		}
+	}()
+	offset := fileSize(part)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return "", false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if meta.Validator != "" {
+			req.Header.Set("If-Range", meta.Validator)
+		}
 	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		return "", false, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("http %d", resp.StatusCode)
+	contentType = resp.Header.Get("Content-Type")
+
+	flags := os.O_CREATE | os.O_WRONLY
+	total := int64(-1) // полный размер файла, -1 — неизвестен
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// сервер не поддерживает Range, part пуст или файл на сервере сменился (If-Range) — качаем заново
+		flags |= os.O_TRUNC
+		offset = 0
+		total = resp.ContentLength
+		meta.Validator = responseValidator(resp)
+		if err := savePartMeta(part, *meta); err != nil {
+			return contentType, false, err
+		}
+	case http.StatusPartialContent:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			_ = os.Remove(part)
+			return "", false, fmt.Errorf("неожиданный Content-Range: %q", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+		total = size
+		if total < 0 && resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// part уже не короче файла на сервере: "bytes */<size>"
+		_, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if ok && size == offset {
+			return "", true, nil
+		}
+		_ = os.Remove(part)
+		return "", false, fmt.Errorf("http 416, part %d байт, на сервере %d", offset, size)
+	default:
+		return "", false, fmt.Errorf("http %d", resp.StatusCode)
 	}
-	f, err := os.Create(path)
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return "", false, err
+	}
+	n, copyErr := io.Copy(f, &idleReader{r: &limitedReader{ctx: ctx, r: resp.Body, l: &downloadLimiter}, timer: idle})
+	if err := f.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if copyErr != nil {
+		return contentType, false, copyErr
+	}
+	got := offset + n
+	if total >= 0 && got != total {
+		if got > total {
+			_ = os.Remove(part)
+		}
+		return contentType, false, fmt.Errorf("размер %d байт, ожидалось %d", got, total)
+	}
+	return contentType, true, nil
+}
+
+// parseContentRange разбирает "bytes 100-199/1000" и "bytes */1000". size=-1, если полный размер "*".
+func parseContentRange(h string) (start, size int64, ok bool) {
+	h = strings.TrimSpace(h)
+	if !strings.HasPrefix(h, "bytes ") {
+		return 0, 0, false
+	}
+	rng, sz, found := strings.Cut(strings.TrimPrefix(h, "bytes "), "/")
+	if !found {
+		return 0, 0, false
+	}
+	size = -1
+	if sz != "*" {
+		v, err := strconv.ParseInt(sz, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		size = v
+	}
+	if rng == "*" {
+		return 0, size, true
+	}
+	from, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, false
+	}
+	v, err := strconv.ParseInt(from, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return v, size, true
+}
+
+// verifyChecksum сверяет хеш файла с checksum из MediaItem: "sha256:<hex>", "md5:<hex>"
+// или просто hex (алгоритм по длине). Пустой checksum — проверки нет.
+func verifyChecksum(path, checksum string) error {
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	if checksum == "" {
+		return nil
+	}
+	algo, want, found := strings.Cut(checksum, ":")
+	if !found {
+		want = algo
+		switch len(want) {
+		case sha256.Size * 2:
+			algo = "sha256"
+		case md5.Size * 2:
+			algo = "md5"
+		}
+	}
+	var h hash.Hash
+	switch algo {
+	case "sha256":
+		h = sha256.New()
+	case "md5":
+		h = md5.New()
+	default:
+		logSync.Warn("неизвестный алгоритм checksum, проверка пропущена", "checksum", checksum)
+		return nil
+	}
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = io.Copy(f, resp.Body)
-	return err
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("checksum не совпал: %s:%s, ожидалось %s", algo, got, want)
+	}
+	return nil
 }
 
 // runStartupChecks проверяет зависимости и окружение перед работой; при отсутствии mplayer/mpv и ffmpeg — выход.
@@ -465,28 +1256,28 @@ func runStartupChecks() {
 		}
 	}
 	if videoPlayerCmd == "" {
-		fmt.Fprintln(os.Stderr, "[mediaplayer] ошибка: не найден mplayer или mpv. Установите: apt install mplayer  или  pacman -S mpv")
+		logMain.Error("не найден mplayer или mpv. Установите: apt install mplayer  или  pacman -S mpv")
 		os.Exit(1)
 	}
-	fmt.Printf("[mediaplayer] проверка: %s найден\n", videoPlayerCmd)
+	logMain.Info("проверка: плеер найден", "player", videoPlayerCmd)
 	if _, err := exec.LookPath("ffmpeg"); err != nil {
-		fmt.Fprintln(os.Stderr, "[mediaplayer] ошибка: ffmpeg не найден. Установите: apt install ffmpeg  или  pacman -S ffmpeg")
+		logMain.Error("ffmpeg не найден. Установите: apt install ffmpeg  или  pacman -S ffmpeg")
 		os.Exit(1)
 	}
-	fmt.Println("[mediaplayer] проверка: ffmpeg найден")
+	logMain.Info("проверка: ffmpeg найден")
 
 	// 2) аудио: есть ли хотя бы одна звуковая карта
 	if data, err := os.ReadFile("/proc/asound/cards"); err != nil || strings.TrimSpace(string(data)) == "" || strings.Contains(string(data), "no soundcards") {
-		fmt.Fprintln(os.Stderr, "[mediaplayer] предупреждение: звуковые карты не найдены (aplay -l). Звук может не работать.")
+		logMain.Warn("звуковые карты не найдены (aplay -l), звук может не работать")
 	} else {
-		fmt.Println("[mediaplayer] проверка: звуковые карты обнаружены")
+		logMain.Info("проверка: звуковые карты обнаружены")
 	}
 
 	// 3) экран 1280x720: при X11 выставляем разрешение сразу
 	if mplayerDisplay() != "" {
 		setDisplayResolution1280x720()
 	} else {
-		fmt.Println("[mediaplayer] проверка: X11 не активен, вывод будет в fbdev2 (разрешение из загрузки)")
+		logMain.Info("проверка: X11 не активен, вывод будет в fbdev2 (разрешение из загрузки)")
 	}
 }
 
@@ -532,7 +1323,7 @@ func setDisplayResolution1280x720() {
 		return cmd.Run() == nil
 	}
 	if tryMode("1280x720") || tryMode("1280x720_60.00") || tryMode("1280x720_60") {
-		fmt.Println("[mediaplayer] разрешение экрана: 1280x720")
+		logPlayer.Info("разрешение экрана: 1280x720")
 	}
 }
 
@@ -612,12 +1403,13 @@ func cleanupByIDs(dir string, keepIDs map[string]bool) {
 		return
 	}
 	for _, e := range entries {
-		if e.IsDir() {
-			continue
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue // служебные файлы (манифест, логи) не трогаем
 		}
 		base := e.Name()
-		ext := filepath.Ext(base)
-		id := strings.TrimSuffix(base, ext)
+		// недокачанный <id>.part относится к тому же id — его оставляем для докачки
+		id := strings.TrimSuffix(base, ".part")
+		id = strings.TrimSuffix(id, filepath.Ext(id))
 		if id == "" {
 			continue
 		}
@@ -631,7 +1423,7 @@ func cleanupByIDs(dir string, keepIDs map[string]bool) {
 // Если DISPLAY пустой (запуск из SSH/консоли), но X11 запущен (LightDM/XFCE), используем :0.
 // Переменная MPLAYER_VO переопределяет выбор (например MPLAYER_VO=x11 или MPLAYER_VO=fbdev2).
 func mplayerVideoOutput() string {
-	if v := os.Getenv("MPLAYER_VO"); v != "" {
+	if v := configValue("MPLAYER_VO"); v != "" {
 		return v
 	}
 	if os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != "" {
@@ -689,11 +1481,10 @@ func xauthPath() string {
 	return ""
 }
 
-// runConcatPlayback запускает mplayer/mpv с плейлистом файлов (без ffmpeg concat).
+// runConcatPlayback запускает mplayer/mpv с плейлистом entries (без ffmpeg concat); вывод плеера пишется в out.
 // Плейлист работает стабильнее на стыках файлов, чем склеивание через pipe.
-func runConcatPlayback(mediaDir string) (ffmpeg *exec.Cmd, mplayer *exec.Cmd) {
-	files := listVideoFiles(mediaDir)
-	if len(files) == 0 {
+func runConcatPlayback(out io.Writer, entries []playlistEntry) (ffmpeg *exec.Cmd, mplayer *exec.Cmd) {
+	if len(entries) == 0 {
 		return nil, nil
 	}
 	// Видеовыход: в графической среде (десктоп) — x11, иначе fbdev2/drm (консоль/без дисплея)
@@ -707,8 +1498,8 @@ func runConcatPlayback(mediaDir string) (ffmpeg *exec.Cmd, mplayer *exec.Cmd) {
 			mpvVo = "drm"
 		}
 		args := []string{
-			"--quiet",             // убрать вывод в консоль (скрыть терминал)
-			"--no-terminal",       // не использовать терминал
+			"--quiet",             // без строки статуса, только сообщения (в лог)
+			"--input-terminal=no", // не читать stdin (--no-terminal глушит и вывод, а он нужен супервизору)
 			"--loop-playlist=inf", // бесконечный повтор плейлиста
 			"--vo=" + mpvVo,
 			"--ao=alsa:device=" + audioDevice,
@@ -716,23 +1507,33 @@ func runConcatPlayback(mediaDir string) (ffmpeg *exec.Cmd, mplayer *exec.Cmd) {
 			"--cache=yes", "--demuxer-max-bytes=150M",
 			"--video-sync=display-resample", // синхронизация видео (исправляет рассинхрон)
 			"--audio-buffer=0.5",            // буфер звука для плавности
+			// управление без перезапуска: смена плейлиста, пауза, громкость (см. mpvipc.go)
+			"--input-ipc-server=" + statePath(mpvSocket),
 		}
 		if vo == "x11" {
 			args = append(args, "--fs")
 		}
-		// Добавляем все файлы как аргументы
-		args = append(args, files...)
-		mplayer = exec.Command("mpv", args...)
-		// Логируем ошибки в файл для отладки (но не выводим на экран)
-		logFile, err := os.OpenFile(filepath.Join(mediaDir, ".mpv-errors.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		if err == nil {
-			mplayer.Stderr = logFile
-			mplayer.Stdout = logFile // также логируем stdout для отладки
-		} else {
-			// Если не удалось открыть файл, перенаправляем в /dev/null
-			mplayer.Stdout = nil
-			mplayer.Stderr = nil
+		if vol := playerVolume.Load(); vol >= 0 {
+			args = append(args, fmt.Sprintf("--volume=%d", vol))
+		}
+		// Добавляем все файлы как аргументы; ограничение длительности — опцией в группе --{ ... --} для этого файла
+		for _, e := range entries {
+			opts := mpvFileOptions(e)
+			if opts == nil {
+				args = append(args, e.Path)
+				continue
+			}
+			args = append(args, "--{")
+			for k, v := range opts {
+				args = append(args, "--"+k+"="+v)
+			}
+			args = append(args, e.Path, "--}")
 		}
+		mplayer = exec.Command("mpv", args...)
+		mplayer.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // своя группа: при остановке завершаем плеер целиком
+		// stdout и stderr — в лог; по строкам "Playing: ..." супервизор знает текущий файл
+		mplayer.Stdout = out
+		mplayer.Stderr = out
 		if vo == "x11" && mplayerDisplay() != "" {
 			env := os.Environ()
 			var filtered []string
@@ -748,7 +1549,7 @@ func runConcatPlayback(mediaDir string) (ffmpeg *exec.Cmd, mplayer *exec.Cmd) {
 			mplayer.Env = filtered
 		}
 		if err := mplayer.Start(); err != nil {
-			fmt.Fprintf(os.Stderr, "mpv start: %v\n", err)
+			logPlayer.Error("mpv не запустился", "err", err)
 			return nil, nil
 		}
 		return nil, mplayer // ffmpeg больше не нужен
@@ -773,19 +1574,26 @@ func runConcatPlayback(mediaDir string) (ffmpeg *exec.Cmd, mplayer *exec.Cmd) {
 	if vo == "x11" {
 		args = append(args, "-fs")
 	}
-	// Добавляем все файлы как аргументы
-	args = append(args, files...)
-	mplayer = exec.Command("mplayer", args...)
-	// Логируем ошибки в файл для отладки
-	logFile, err := os.OpenFile(filepath.Join(mediaDir, ".mplayer-errors.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err == nil {
-		mplayer.Stderr = logFile
-		mplayer.Stdout = nil // stdout не нужен
-	} else {
-		// Если не удалось открыть файл, перенаправляем в /dev/null
-		mplayer.Stdout = nil
-		mplayer.Stderr = nil
+	if vol := playerVolume.Load(); vol >= 0 {
+		args = append(args, "-volume", fmt.Sprint(vol))
 	}
+	// Добавляем все файлы как аргументы; опции после имени файла действуют только на этот файл
+	for _, e := range entries {
+		if e.Image {
+			// картинка — кадр через mf:// с частотой 1/длительность, т.е. один кадр на MaxDuration секунд
+			args = append(args, "mf://"+e.Path, "-mf", "fps="+formatSeconds(1/e.MaxDuration))
+			continue
+		}
+		args = append(args, e.Path)
+		if e.MaxDuration > 0 {
+			args = append(args, "-endpos", formatSeconds(e.MaxDuration))
+		}
+	}
+	mplayer = exec.Command("mplayer", args...)
+	mplayer.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // своя группа: при остановке завершаем плеер целиком
+	// stdout и stderr — в лог; по строкам "Playing ..." супервизор знает текущий файл
+	mplayer.Stdout = out
+	mplayer.Stderr = out
 	if vo == "x11" && mplayerDisplay() != "" {
 		env := os.Environ()
 		var filtered []string
@@ -801,13 +1609,14 @@ func runConcatPlayback(mediaDir string) (ffmpeg *exec.Cmd, mplayer *exec.Cmd) {
 		mplayer.Env = filtered
 	}
 	if err := mplayer.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "mplayer start: %v\n", err)
+		logPlayer.Error("mplayer не запустился", "err", err)
 		return nil, nil
 	}
 	return nil, mplayer // ffmpeg больше не нужен
 }
 
-func listVideoFiles(mediaDir string) []string {
+// listMediaFiles возвращает видео, картинки и аудио из mediaDir (по алфавиту).
+func listMediaFiles(mediaDir string) []string {
 	entries, err := os.ReadDir(mediaDir)
 	if err != nil {
 		return nil
@@ -817,9 +1626,7 @@ func listVideoFiles(mediaDir string) []string {
 		if e.IsDir() {
 			continue
 		}
-		name := strings.ToLower(e.Name())
-		if strings.HasSuffix(name, ".mkv") || strings.HasSuffix(name, ".mp4") ||
-			strings.HasSuffix(name, ".avi") || strings.HasSuffix(name, ".webm") {
+		if hasExt(e.Name(), videoExts) || hasExt(e.Name(), imageExts) || hasExt(e.Name(), audioExts) {
 			files = append(files, filepath.Join(mediaDir, e.Name()))
 		}
 	}
@@ -827,6 +1634,6 @@ func listVideoFiles(mediaDir string) []string {
 }
 
 func exit(err error) {
-	fmt.Fprintln(os.Stderr, err)
+	logMain.Error("фатальная ошибка", "err", err)
 	os.Exit(1)
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		h           string
+		start, size int64
+		ok          bool
+	}{
+		{"bytes 100-199/1000", 100, 1000, true},
+		{"bytes 0-0/1", 0, 1, true},
+		{" bytes 5-9/* ", 5, -1, true},
+		{"bytes */1000", 0, 1000, true},
+		{"bytes */*", 0, -1, true},
+		{"", 0, 0, false},
+		{"items 0-9/10", 0, 0, false},
+		{"bytes 0-9", 0, 0, false},
+		{"bytes 0/10", 0, 0, false},
+		{"bytes x-9/10", 0, 0, false},
+		{"bytes 0-9/ten", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, size, ok := parseContentRange(tt.h)
+		if start != tt.start || size != tt.size || ok != tt.ok {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v; want %d, %d, %v", tt.h, start, size, ok, tt.start, tt.size, tt.ok)
+		}
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.mp4")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const (
+		sha = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		md5 = "5d41402abc4b2a76b9719d911017c592"
+	)
+	tests := []struct {
+		checksum string
+		ok       bool
+	}{
+		{"", true},
+		{"sha256:" + sha, true},
+		{"SHA256:" + sha, true},
+		{" " + sha + " ", true},
+		{"md5:" + md5, true},
+		{md5, true},
+		{"crc32:3610a686", true}, // неизвестный алгоритм — проверки нет
+		{"sha256:" + md5, false},
+		{"md5:" + sha[:32], false},
+		{sha[:63] + "0", false},
+	}
+	for _, tt := range tests {
+		if err := verifyChecksum(path, tt.checksum); (err == nil) != tt.ok {
+			t.Errorf("verifyChecksum(%q) = %v, want ok=%v", tt.checksum, err, tt.ok)
+		}
+	}
+	if err := verifyChecksum(filepath.Join(t.TempDir(), "missing"), "md5:"+md5); err == nil {
+		t.Error("verifyChecksum: нет ошибки для несуществующего файла")
+	}
+}
+
+// serveMedia отдаёт data с ETag etag через http.ServeContent (Range, If-Range, 416 — как у обычного
+// файлового сервера) и запоминает заголовок Range последнего запроса.
+func serveMedia(t *testing.T, data []byte, etag string, gotRange *string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*gotRange = r.Header.Get("Range")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloadPart(t *testing.T) {
+	data := []byte("hello, world")
+	tests := []struct {
+		name      string
+		part      []byte // что уже скачано; nil — part нет
+		validator string // ETag, с которым скачан part
+		wantRange string
+		wantDone  bool
+		wantPart  []byte // nil — part удалён
+	}{
+		{"с нуля", nil, "", "", true, data},
+		{"докачка с Range", data[:5], `"v1"`, "bytes=5-", true, data},
+		// файл на сервере сменился: If-Range не совпал, сервер отдаёт 200 целиком, part перезаписывается
+		{"If-Range не совпал", []byte("HELLO"), `"old"`, "bytes=5-", true, data},
+		// part уже целиком: 416 с "bytes */<size>" — загрузка закончена
+		{"416, part полный", data, `"v1"`, "bytes=12-", true, data},
+		// part длиннее файла на сервере — начинаем заново
+		{"416, part длиннее", append(append([]byte{}, data...), "!!!"...), `"v1"`, "bytes=15-", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotRange string
+			srv := serveMedia(t, data, `"v1"`, &gotRange)
+			part := filepath.Join(t.TempDir(), "a.part")
+			if tt.part != nil {
+				if err := os.WriteFile(part, tt.part, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			meta := partMeta{Version: "url:" + srv.URL, Validator: tt.validator}
+			_, done, err := downloadPart(context.Background(), srv.URL, part, &meta)
+			if done != tt.wantDone {
+				t.Errorf("done = %v (err %v), want %v", done, err, tt.wantDone)
+			}
+			if gotRange != tt.wantRange {
+				t.Errorf("Range = %q, want %q", gotRange, tt.wantRange)
+			}
+			got, err := os.ReadFile(part)
+			switch {
+			case tt.wantPart == nil && err == nil:
+				t.Errorf("part не удалён: %q", got)
+			case tt.wantPart != nil && !bytes.Equal(got, tt.wantPart):
+				t.Errorf("part = %q (%v), want %q", got, err, tt.wantPart)
+			}
+			if tt.wantDone && meta.Validator != `"v1"` {
+				t.Errorf("validator = %q, want \"v1\"", meta.Validator)
+			}
+		})
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	data := []byte("hello, world")
+	var gotRange string
+	srv := serveMedia(t, data, `"v1"`, &gotRange)
+	dir := t.TempDir()
+
+	it := MediaItem{ID: "a", URL: srv.URL, Checksum: "md5:e4d7f1b4ed2e42d15898f4b27b019da4"}
+	part := filepath.Join(dir, "a.part")
+	if err := os.WriteFile(part, data[:5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePartMeta(part, partMeta{Version: itemVersion(it), Validator: `"v1"`}); err != nil {
+		t.Fatal(err)
+	}
+	ct, err := downloadFile(context.Background(), it, part)
+	if err != nil || ct != "video/mp4" || gotRange != "bytes=5-" {
+		t.Fatalf("downloadFile = %q, %v (Range %q); want докачку с 5 байта", ct, err, gotRange)
+	}
+	if _, err := os.Stat(partMetaPath(part)); err == nil {
+		t.Error("описание part не удалено после загрузки")
+	}
+
+	// part от другой версии элемента не докачивается
+	if err := os.WriteFile(part, []byte("HELLO"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePartMeta(part, partMeta{Version: "checksum:other", Validator: `"v1"`}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := downloadFile(context.Background(), it, part); err != nil || gotRange != "" {
+		t.Fatalf("downloadFile = %v (Range %q); want загрузку с нуля", err, gotRange)
+	}
+	if got, _ := os.ReadFile(part); !bytes.Equal(got, data) {
+		t.Errorf("part = %q, want %q", got, data)
+	}
+
+	// размер не совпал с size из плейлиста — part удаляется
+	_ = os.Remove(part)
+	if _, err := downloadFile(context.Background(), MediaItem{ID: "a", URL: srv.URL, Size: 100}, part); err == nil {
+		t.Error("downloadFile: нет ошибки при несовпадении размера")
+	}
+	if _, err := os.Stat(part); err == nil {
+		t.Error("part не удалён при несовпадении размера")
+	}
+
+	// checksum не совпал — part удаляется
+	if _, err := downloadFile(context.Background(), MediaItem{ID: "a", URL: srv.URL, Checksum: "md5:00000000000000000000000000000000"}, part); err == nil {
+		t.Error("downloadFile: нет ошибки при несовпадении checksum")
+	}
+	if _, err := os.Stat(part); err == nil {
+		t.Error("part не удалён при несовпадении checksum")
+	}
+}
+
+func TestDownloadMediaBudget(t *testing.T) {
+	stateDir = t.TempDir()
+	dir := t.TempDir()
+	const size = 3 << 20
+	var gotRange string
+	srv := serveMedia(t, make([]byte, size), `"v1"`, &gotRange)
+	items := []MediaItem{
+		{ID: "a", URL: srv.URL + "/a.mp4", Size: size},
+		{ID: "b", URL: srv.URL + "/b.mp4", Size: size},
+		{ID: "c", URL: srv.URL + "/c.mp4"}, // размер узнаётся из HEAD
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skip(err)
+	}
+	// места — на один файл и ещё полтора мегабайта: b и c не помещаются
+	minFree := free - (size + 3<<19)
+	ready, err := downloadMedia(context.Background(), dir, loadManifest(), items, 1, minFree, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ready) != 1 || ready[0].ID != "a" {
+		t.Fatalf("ready = %v, want только a", ready)
+	}
+	st := diskStatus.Load()
+	// не хватило 3+3+3-4.5 = 4.5 MB, с округлением вверх — 5
+	if st == nil || !st.Full || st.Skipped != 2 || st.RequiredMB != 5 {
+		t.Errorf("diskStatus = %+v, want full, skipped 2, requiredMb 5", st)
+	}
+}
+
+func TestSyncMediaFileRejectsHTML(t *testing.T) {
+	stateDir = t.TempDir()
+	dir := t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<!DOCTYPE html><title>Login</title>"))
+	}))
+	defer srv.Close()
+	var mu sync.Mutex
+	manifest := loadManifest()
+	if err := syncMediaFile(context.Background(), dir, manifest, &mu, MediaItem{ID: "a", URL: srv.URL + "/a.mp4"}); err == nil {
+		t.Fatal("syncMediaFile: нет ошибки для страницы вместо файла")
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("в MEDIA_DIR остались файлы: %v", files)
+	}
+	if _, ok := manifest.Files["a"]; ok {
+		t.Error("страница попала в манифест")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestFile — локальный манифест скачанных файлов в STATE_DIR.
+const manifestFile = "manifest.json"
+
+// manifestEntry — что известно о скачанном файле: по этим полям решаем, качать ли его заново.
+type manifestEntry struct {
+	ID           string    `json:"id"`
+	URL          string    `json:"url"`
+	File         string    `json:"file"` // имя файла в MEDIA_DIR
+	Size         int64     `json:"size"`
+	Type         string    `json:"type,omitempty"` // MIME-тип, определённый при загрузке
+	Checksum     string    `json:"checksum,omitempty"`
+	UpdatedAt    string    `json:"updatedAt,omitempty"`
+	DownloadedAt time.Time `json:"downloadedAt"`
+}
+
+type mediaManifest struct {
+	Files map[string]manifestEntry `json:"files"` // ключ — fileID(id)
+	// Playlist — последний успешно загруженный плейлист; с него стартуем без сети и без JWT
+	Playlist  []MediaItem `json:"playlist,omitempty"`
+	FetchedAt time.Time   `json:"fetchedAt,omitempty"`
+}
+
+// loadManifest читает манифест; при отсутствии или порче возвращает пустой.
+func loadManifest() *mediaManifest {
+	m := &mediaManifest{}
+	if unlock, err := lockState(false); err == nil {
+		if b, err := os.ReadFile(statePath(manifestFile)); err == nil {
+			_ = json.Unmarshal(b, m)
+		}
+		unlock()
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]manifestEntry)
+	}
+	return m
+}
+
+// save пишет манифест атомарно (через временный файл), чтобы обрыв питания не оставил половину JSON.
+func (m *mediaManifest) save() error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	unlock, err := lockState(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(statePath(manifestFile), b, 0644)
+}
+
+// upToDate возвращает путь к уже скачанному файлу it, если его содержимое не менялось.
+// Сравнение: checksum, если сервер его прислал; иначе updatedAt; иначе URL. Размер сверяется всегда.
+func (m *mediaManifest) upToDate(dir string, it MediaItem) (string, bool) {
+	e, ok := m.Files[fileID(it.ID)]
+	if !ok || e.File == "" {
+		return "", false
+	}
+	path := filepath.Join(dir, e.File)
+	st, err := os.Stat(path)
+	if err != nil || st.Size() != e.Size {
+		return "", false
+	}
+	if it.Size > 0 && it.Size != e.Size {
+		return "", false
+	}
+	switch {
+	case it.Checksum != "":
+		return path, strings.EqualFold(strings.TrimSpace(it.Checksum), e.Checksum)
+	case it.UpdatedAt != "":
+		return path, it.UpdatedAt == e.UpdatedAt
+	default:
+		return path, it.URL == e.URL
+	}
+}
+
+// adopt заносит в манифест файл id, скачанный ранее без манифеста, если он совпал по checksum.
+func (m *mediaManifest) adopt(dir string, it MediaItem) (string, bool) {
+	if it.Checksum == "" {
+		return "", false
+	}
+	for ext := range mediaTypes {
+		path := filepath.Join(dir, fileID(it.ID)+ext)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := verifyChecksum(path, it.Checksum); err != nil {
+			continue
+		}
+		return path, m.record(path, it) == nil
+	}
+	return "", false
+}
+
+// record запоминает только что скачанный файл.
+func (m *mediaManifest) record(path string, it MediaItem) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	m.Files[fileID(it.ID)] = manifestEntry{
+		ID:           it.ID,
+		URL:          it.URL,
+		File:         filepath.Base(path),
+		Size:         st.Size(),
+		Type:         mediaTypes[strings.ToLower(filepath.Ext(path))],
+		Checksum:     strings.TrimSpace(it.Checksum),
+		UpdatedAt:    it.UpdatedAt,
+		DownloadedAt: time.Now(),
+	}
+	return nil
+}
+
+// setPlaylist запоминает items как последний рабочий плейлист.
+func (m *mediaManifest) setPlaylist(items []MediaItem) {
+	m.Playlist = items
+	m.FetchedAt = time.Now()
+}
+
+// playlistEntries строит плейлист из элементов последнего рабочего плейлиста, которые по расписанию
+// играют в момент now и чьи файлы есть на диске.
+func (m *mediaManifest) playlistEntries(dir string, now time.Time) []playlistEntry {
+	return buildPlaylist(activeItems(m.Playlist, now), func(it MediaItem) string {
+		e, ok := m.Files[fileID(it.ID)]
+		if !ok || e.File == "" {
+			return ""
+		}
+		path := filepath.Join(dir, e.File)
+		if _, err := os.Stat(path); err != nil {
+			return ""
+		}
+		return path
+	})
+}
+
+// prune убирает из манифеста записи, которых нет в keepIDs.
+func (m *mediaManifest) prune(keepIDs map[string]bool) {
+	for id := range m.Files {
+		if !keepIDs[id] {
+			delete(m.Files, id)
+		}
+	}
+}
+
+// removeStale удаляет файлы с id из манифеста, но с другим расширением (формат файла сменился).
+func (m *mediaManifest) removeStale(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, de := range entries {
+		name := de.Name()
+		if de.IsDir() || strings.HasSuffix(name, ".part") {
+			continue
+		}
+		e, ok := m.Files[strings.TrimSuffix(name, filepath.Ext(name))]
+		if ok && e.File != "" && e.File != name {
+			_ = os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+// writeFileAtomic пишет data во временный файл рядом с path и переименовывает его в path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// itemVersion — версия содержимого элемента, по которой upToDate решает, менялся ли файл.
+func itemVersion(it MediaItem) string {
+	switch {
+	case it.Checksum != "":
+		return "checksum:" + strings.ToLower(strings.TrimSpace(it.Checksum))
+	case it.UpdatedAt != "":
+		return "updatedAt:" + it.UpdatedAt
+	default:
+		return "url:" + it.URL
+	}
+}
+
+// partMeta — к какой версии элемента относится недокачанный <id>.part и чем сервер её пометил.
+type partMeta struct {
+	Version   string `json:"version"`             // itemVersion
+	Validator string `json:"validator,omitempty"` // ETag или Last-Modified первого ответа — для If-Range
+}
+
+// partMetaPath — <id>.meta.part рядом с <id>.part: для очистки MEDIA_DIR это тот же id.
+func partMetaPath(part string) string {
+	return strings.TrimSuffix(part, ".part") + ".meta.part"
+}
+
+// loadPartMeta читает описание part; пустое — описания нет (part от старой версии программы или его нет).
+func loadPartMeta(part string) partMeta {
+	var m partMeta
+	if b, err := os.ReadFile(partMetaPath(part)); err == nil {
+		_ = json.Unmarshal(b, &m)
+	}
+	return m
+}
+
+func savePartMeta(part string, m partMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(partMetaPath(part), b, 0644)
+}
+
+// responseValidator возвращает строгий ETag ответа, иначе Last-Modified (слабый ETag для If-Range не годится).
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
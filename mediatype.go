@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// mediaTypes — поддерживаемые форматы: расширение файла на диске и MIME-тип для манифеста.
+var mediaTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".mkv":  "video/x-matroska",
+	".webm": "video/webm",
+	".avi":  "video/x-msvideo",
+	".ts":   "video/mp2t",
+	".mpg":  "video/mpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".ogg":  "audio/ogg",
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
+}
+
+// contentTypeExts — расширение по заголовку Content-Type (когда сигнатура файла не распознана).
+var contentTypeExts = map[string]string{
+	"video/mp4":        ".mp4",
+	"video/x-m4v":      ".m4v",
+	"video/quicktime":  ".mov",
+	"video/x-matroska": ".mkv",
+	"video/webm":       ".webm",
+	"video/x-msvideo":  ".avi",
+	"video/avi":        ".avi",
+	"video/mp2t":       ".ts",
+	"video/mpeg":       ".mpg",
+	"image/jpeg":       ".jpg",
+	"image/png":        ".png",
+	"image/gif":        ".gif",
+	"image/webp":       ".webp",
+	"audio/mpeg":       ".mp3",
+	"audio/mp4":        ".m4a",
+	"audio/ogg":        ".ogg",
+	"audio/flac":       ".flac",
+	"audio/wav":        ".wav",
+	"audio/x-wav":      ".wav",
+}
+
+// detectMediaExt определяет расширение скачанного файла: сначала по сигнатуре (magic bytes),
+// затем по Content-Type ответа, затем по расширению в пути URL. "" — формат не распознан
+// (в том числе когда Content-Type точно не медиа, какой бы ни была ссылка).
+func detectMediaExt(file, contentType, rawURL string) string {
+	if ext := sniffMediaExt(file); ext != "" {
+		return ext
+	}
+	if notMediaType(contentType) {
+		return ""
+	}
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		if ext, ok := contentTypeExts[strings.ToLower(mt)]; ok {
+			return ext
+		}
+	}
+	return extFromURL(rawURL)
+}
+
+// notMediaType сообщает, что Content-Type точно не медиа: страница ошибки или входа (text/html),
+// JSON, XML. Пустой и application/octet-stream — неизвестно, не медиа не считаются.
+func notMediaType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	mt = strings.ToLower(mt)
+	return strings.HasPrefix(mt, "text/") || mt == "application/json" || mt == "application/xml" ||
+		strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+xml")
+}
+
+// sniffMediaExt распознаёт контейнер по первым байтам файла.
+func sniffMediaExt(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	b := make([]byte, 512)
+	n, _ := io.ReadFull(f, b)
+	b = b[:n]
+	switch {
+	case len(b) >= 12 && string(b[4:8]) == "ftyp":
+		switch brand := string(b[8:12]); {
+		case brand == "qt  ":
+			return ".mov"
+		case strings.HasPrefix(brand, "M4V"):
+			return ".m4v"
+		case brand == "M4A " || brand == "M4B ":
+			return ".m4a"
+		default:
+			return ".mp4"
+		}
+	case bytes.HasPrefix(b, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// EBML: webm и mkv различаются DocType в заголовке
+		if bytes.Contains(b[:min(len(b), 64)], []byte("webm")) {
+			return ".webm"
+		}
+		return ".mkv"
+	case len(b) >= 12 && string(b[:4]) == "RIFF":
+		switch string(b[8:12]) {
+		case "AVI ":
+			return ".avi"
+		case "WAVE":
+			return ".wav"
+		case "WEBP":
+			return ".webp"
+		}
+	case len(b) > 376 && b[0] == 0x47 && b[188] == 0x47 && b[376] == 0x47:
+		return ".ts" // MPEG-TS: sync byte каждые 188 байт
+	case bytes.HasPrefix(b, []byte{0x00, 0x00, 0x01, 0xBA}):
+		return ".mpg"
+	case bytes.HasPrefix(b, []byte{0xFF, 0xD8, 0xFF}):
+		return ".jpg"
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	case bytes.HasPrefix(b, []byte("GIF8")):
+		return ".gif"
+	case bytes.HasPrefix(b, []byte("OggS")):
+		return ".ogg"
+	case bytes.HasPrefix(b, []byte("fLaC")):
+		return ".flac"
+	case bytes.HasPrefix(b, []byte("ID3")), len(b) >= 2 && b[0] == 0xFF && b[1]&0xE0 == 0xE0:
+		return ".mp3"
+	}
+	return ""
+}
+
+// extFromURL берёт расширение из пути URL (без query), если это поддерживаемый формат.
+func extFromURL(rawURL string) string {
+	p := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		p = u.Path
+	}
+	ext := strings.ToLower(path.Ext(p))
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	if _, ok := mediaTypes[ext]; ok {
+		return ext
+	}
+	return ""
+}
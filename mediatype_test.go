@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSniffMediaExt(t *testing.T) {
+	ts := make([]byte, 188*3)
+	ts[0], ts[188], ts[376] = 0x47, 0x47, 0x47
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"mp4", []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00"), ".mp4"},
+		{"mov", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00"), ".mov"},
+		{"m4v", []byte("\x00\x00\x00\x18ftypM4V \x00\x00\x02\x00"), ".m4v"},
+		{"m4a", []byte("\x00\x00\x00\x18ftypM4A \x00\x00\x02\x00"), ".m4a"},
+		{"webm", append([]byte{0x1A, 0x45, 0xDF, 0xA3, 0x9F, 0x42, 0x82, 0x84}, "webm"...), ".webm"},
+		{"mkv", append([]byte{0x1A, 0x45, 0xDF, 0xA3, 0x9F, 0x42, 0x82, 0x88}, "matroska"...), ".mkv"},
+		{"avi", []byte("RIFF\x00\x00\x00\x00AVI LIST"), ".avi"},
+		{"wav", []byte("RIFF\x00\x00\x00\x00WAVEfmt "), ".wav"},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), ".webp"},
+		{"ts", ts, ".ts"},
+		{"mpg", []byte{0x00, 0x00, 0x01, 0xBA, 0x44}, ".mpg"},
+		{"jpg", []byte{0xFF, 0xD8, 0xFF, 0xE0}, ".jpg"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00"), ".png"},
+		{"gif", []byte("GIF89a"), ".gif"},
+		{"ogg", []byte("OggS\x00\x02"), ".ogg"},
+		{"flac", []byte("fLaC\x00\x00"), ".flac"},
+		{"mp3 с ID3", []byte("ID3\x04\x00"), ".mp3"},
+		{"mp3 без ID3", []byte{0xFF, 0xFB, 0x90, 0x64}, ".mp3"},
+		{"html", []byte("<!DOCTYPE html><html>"), ""},
+		{"RIFF другого типа", []byte("RIFF\x00\x00\x00\x00CDXA"), ""},
+		{"короткий ftyp", []byte("\x00\x00\x00\x18ftyp"), ""},
+		{"пустой", nil, ""},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "media.part")
+		if err := os.WriteFile(path, tt.head, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := sniffMediaExt(path); got != tt.want {
+			t.Errorf("%s: sniffMediaExt = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := sniffMediaExt(filepath.Join(dir, "missing")); got != "" {
+		t.Errorf("sniffMediaExt(нет файла) = %q, want \"\"", got)
+	}
+	// webm по DocType только в начале заголовка: "webm" дальше — это mkv
+	late := append([]byte{0x1A, 0x45, 0xDF, 0xA3}, bytes.Repeat([]byte{0}, 100)...)
+	path := filepath.Join(dir, "late.part")
+	if err := os.WriteFile(path, append(late, "webm"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := sniffMediaExt(path); got != ".mkv" {
+		t.Errorf("sniffMediaExt(webm после 64 байт) = %q, want .mkv", got)
+	}
+}
+
+func TestDetectMediaExt(t *testing.T) {
+	dir := t.TempDir()
+	png := filepath.Join(dir, "png.part")
+	html := filepath.Join(dir, "html.part")
+	if err := os.WriteFile(png, []byte("\x89PNG\r\n\x1a\n\x00\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(html, []byte("<!DOCTYPE html><title>Login</title>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, file, contentType, url, want string
+	}{
+		{"сигнатура важнее всего", png, "text/html", "https://cdn/a.mp4", ".png"},
+		{"по Content-Type", html, "video/webm; codecs=vp9", "https://cdn/a", ".webm"},
+		{"по URL", html, "application/octet-stream", "https://cdn/a.MOV?sig=1", ".mov"},
+		{"jpeg в URL", html, "", "https://cdn/a.jpeg", ".jpg"},
+		{"страница вместо файла", html, "text/html; charset=utf-8", "https://cdn/a.mp4", ""},
+		{"JSON с ошибкой", html, "application/problem+json", "https://cdn/a.mp4", ""},
+		{"ничего не известно", html, "", "https://cdn/a", ""},
+	}
+	for _, tt := range tests {
+		if got := detectMediaExt(tt.file, tt.contentType, tt.url); got != tt.want {
+			t.Errorf("%s: detectMediaExt = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
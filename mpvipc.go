@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// mpvSocket — сокет JSON IPC mpv в каталоге состояния (--input-ipc-server).
+	mpvSocket = "mpv.sock"
+	// mpvIPCTimeout — сколько ждать появления сокета после запуска mpv и ответа на команду.
+	mpvIPCTimeout = 5 * time.Second
+)
+
+var errIPCClosed = errors.New("mpv IPC: соединение закрыто")
+
+// mpvMessage — строка из сокета mpv: ответ на команду (request_id, error, data)
+// или событие (event и поля события).
+type mpvMessage struct {
+	RequestID int             `json:"request_id"`
+	Error     string          `json:"error"`
+	Data      json.RawMessage `json:"data"`
+
+	Event     string `json:"event"`
+	Name      string `json:"name"`       // property-change: имя свойства
+	Reason    string `json:"reason"`     // end-file: eof, stop, quit, error, redirect
+	FileError string `json:"file_error"` // end-file при reason=error
+}
+
+// mpvIPC — соединение с запущенным mpv по JSON IPC: команды с ответами и поток событий.
+type mpvIPC struct {
+	conn    net.Conn
+	onEvent func(mpvMessage)
+
+	wmu sync.Mutex // одна запись в сокет за раз
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]chan mpvMessage
+	closed  chan struct{}
+}
+
+// dialMPV подключается к сокету mpv; mpv создаёт его не сразу после старта, поэтому
+// подключение повторяется до mpvIPCTimeout. События передаются в onEvent из горутины чтения.
+func dialMPV(ctx context.Context, path string, onEvent func(mpvMessage)) (*mpvIPC, error) {
+	deadline := time.Now().Add(mpvIPCTimeout)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			m := &mpvIPC{conn: conn, onEvent: onEvent, pending: map[int]chan mpvMessage{}, closed: make(chan struct{})}
+			go m.read()
+			return m, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		if !sleepCtx(ctx, 100*time.Millisecond) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (m *mpvIPC) read() {
+	defer close(m.closed)
+	sc := bufio.NewScanner(m.conn)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var msg mpvMessage
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil {
+			continue
+		}
+		if msg.Event != "" {
+			if m.onEvent != nil {
+				m.onEvent(msg)
+			}
+			continue
+		}
+		m.mu.Lock()
+		ch := m.pending[msg.RequestID]
+		delete(m.pending, msg.RequestID)
+		m.mu.Unlock()
+		if ch != nil {
+			ch <- msg
+		}
+	}
+}
+
+// command выполняет команду mpv с позиционными аргументами: command("set_property", "pause", true).
+func (m *mpvIPC) command(args ...any) (json.RawMessage, error) {
+	return m.send(args)
+}
+
+// commandNamed выполняет команду с именованными аргументами — так у loadfile можно передать
+// опции файла, не завися от порядка позиционных аргументов в разных версиях mpv.
+func (m *mpvIPC) commandNamed(name string, args map[string]any) (json.RawMessage, error) {
+	cmd := map[string]any{"name": name}
+	for k, v := range args {
+		cmd[k] = v
+	}
+	return m.send(cmd)
+}
+
+func (m *mpvIPC) send(command any) (json.RawMessage, error) {
+	m.mu.Lock()
+	m.nextID++
+	id := m.nextID
+	ch := make(chan mpvMessage, 1)
+	m.pending[id] = ch
+	m.mu.Unlock()
+	drop := func() {
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+	}
+
+	b, err := json.Marshal(map[string]any{"command": command, "request_id": id})
+	if err != nil {
+		drop()
+		return nil, err
+	}
+	m.wmu.Lock()
+	_ = m.conn.SetWriteDeadline(time.Now().Add(mpvIPCTimeout))
+	_, err = m.conn.Write(append(b, '\n'))
+	m.wmu.Unlock()
+	if err != nil {
+		drop()
+		return nil, err
+	}
+	timeout := time.NewTimer(mpvIPCTimeout)
+	defer timeout.Stop()
+	select {
+	case msg := <-ch:
+		if msg.Error != "success" {
+			return nil, fmt.Errorf("mpv: %s", msg.Error)
+		}
+		return msg.Data, nil
+	case <-m.closed:
+		drop()
+		return nil, errIPCClosed
+	case <-timeout.C:
+		drop()
+		return nil, fmt.Errorf("mpv: нет ответа за %s", mpvIPCTimeout)
+	}
+}
+
+func (m *mpvIPC) Close() error {
+	return m.conn.Close()
+}
+
+// mpvFileOptions — опции mpv для одного элемента плейлиста (как группа --{ ... --} при запуске).
+func mpvFileOptions(e playlistEntry) map[string]string {
+	switch {
+	case e.Image:
+		return map[string]string{"image-display-duration": formatSeconds(e.MaxDuration)}
+	case e.MaxDuration > 0:
+		return map[string]string{"length": formatSeconds(e.MaxDuration)}
+	}
+	return nil
+}
+
+// loadPlaylist заменяет плейлист mpv на entries без перезапуска процесса: первый файл — с флагом replace
+// (текущий сразу сменяется новым), остальные — append.
+func (m *mpvIPC) loadPlaylist(entries []playlistEntry) error {
+	for i, e := range entries {
+		args := map[string]any{"url": e.Path, "flags": "append"}
+		if i == 0 {
+			args["flags"] = "replace"
+		}
+		if opts := mpvFileOptions(e); opts != nil {
+			args["options"] = opts
+		}
+		if _, err := m.commandNamed("loadfile", args); err != nil {
+			return fmt.Errorf("loadfile %s: %w", e.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// playerStopTimeout — сколько ждать выхода плеера после SIGTERM до SIGKILL.
+	playerStopTimeout = 3 * time.Second
+	// Задержка перезапуска упавшего плеера: от playerRestartMin, удваивается до playerRestartMax.
+	playerRestartMin = time.Second
+	playerRestartMax = time.Minute
+	// playerStableAfter — проработал столько без падения — задержка перезапуска снова минимальная.
+	playerStableAfter = 2 * time.Minute
+)
+
+// player держит запущенный mplayer/mpv: запуск плейлиста, остановка и признак «сейчас что-то играет».
+// Пока плейлист не остановлен через stop, супервизор перезапускает упавший плеер (см. supervise).
+type player struct {
+	logDir string
+
+	mu      sync.Mutex
+	entries []playlistEntry // текущий плейлист (как запрошен, без учёта карантина)
+	mplayer *exec.Cmd
+	ffmpeg  *exec.Cmd
+	exited  chan struct{}      // закрывается, когда процесс mplayer завершился
+	cancel  context.CancelFunc // != nil, пока плейлист запущен (в том числе до старта процесса и между перезапусками)
+	current string             // файл, который сейчас играет (по выводу плеера или IPC mpv)
+	ipc     *mpvIPC            // управление mpv по JSON IPC; nil — mplayer или mpv ещё не подключён
+	plays   playLog            // показы для отчёта серверу (proof-of-play)
+
+	crashes     int                    // падений плеера с момента запуска mediaplayer
+	restarts    int                    // перезапусков после падений
+	fileCrashes map[string][]time.Time // недавние падения по файлам — для карантина
+}
+
+// running сообщает, идёт ли воспроизведение.
+func (p *player) running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cancel != nil
+}
+
+// playingEntries сообщает, играет ли сейчас ровно этот плейлист.
+func (p *player) playingEntries(entries []playlistEntry) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel == nil || len(p.entries) != len(entries) {
+		return false
+	}
+	for i := range entries {
+		if p.entries[i] != entries[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// play запускает entries по кругу. Если уже работает mpv, плейлист подменяется через IPC без
+// перезапуска процесса (без мерцания и консоли на экране); иначе плеер перезапускается.
+func (p *player) play(entries []playlistEntry) {
+	if len(entries) > 0 && p.swap(entries) {
+		return
+	}
+	p.stop()
+	if len(entries) == 0 {
+		return
+	}
+	logPlayer.Info("запускаю воспроизведение", "player", videoPlayerCmd, "items", len(entries), "vo", mplayerVideoOutput())
+	setDisplayResolution1280x720() // 1280x720 перед воспроизведением (X11)
+	clearDisplayBlack()            // чёрный до первого кадра
+	ctx, cancel := context.WithCancel(context.Background())
+	p.mu.Lock()
+	p.cancel = cancel
+	p.entries = entries
+	p.mu.Unlock()
+	go p.supervise(ctx)
+}
+
+// swap подменяет плейлист работающего mpv через IPC; false — подменить нельзя, нужен перезапуск.
+func (p *player) swap(entries []playlistEntry) bool {
+	p.mu.Lock()
+	ipc := p.ipc
+	p.mu.Unlock()
+	if ipc == nil {
+		return false
+	}
+	run := playableEntries(entries, time.Now())
+	if len(run) == 0 {
+		return false
+	}
+	if err := ipc.loadPlaylist(run); err != nil {
+		logPlayer.Warn("смена плейлиста через IPC не удалась, перезапускаю плеер", "err", err)
+		return false
+	}
+	p.mu.Lock()
+	p.entries = entries // супервизор перезапустит упавший mpv уже с новым плейлистом
+	p.mu.Unlock()
+	logPlayer.Info("плейлист заменён без перезапуска mpv", "items", len(run))
+	return true
+}
+
+// supervise держит плеер запущенным, пока не отменён ctx. Если процесс завершился сам (битый файл,
+// ошибка ALSA, перезапуск X), плеер перезапускается с экспоненциальной задержкой, а файл, на котором
+// он падает раз за разом, уходит в карантин и из плейлиста.
+func (p *player) supervise(ctx context.Context) {
+	failures := 0 // падений подряд
+	for {
+		p.mu.Lock()
+		entries := p.entries
+		p.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		run := playableEntries(entries, time.Now())
+		if len(run) == 0 {
+			logPlayer.Error("все файлы плейлиста в карантине", "retry_in", quarantineRecheck.String())
+			if !sleepCtx(ctx, quarantineRecheck) {
+				return
+			}
+			continue
+		}
+		p.mu.Lock()
+		if ctx.Err() != nil {
+			p.mu.Unlock()
+			return
+		}
+		out := newPlayerOutput(filepath.Join(p.logDir, videoPlayerCmd+"-errors.log"), p.playing)
+		ffmpeg, mplayer := runConcatPlayback(out, run)
+		exited := make(chan struct{})
+		p.ffmpeg, p.mplayer, p.exited, p.current = ffmpeg, mplayer, exited, ""
+		p.mu.Unlock()
+		if mplayer != nil && videoPlayerCmd == "mpv" {
+			go p.attachIPC(ctx, mplayer, exited)
+		}
+		started := time.Now()
+		err := errors.New("плеер не запустился")
+		if mplayer != nil {
+			err = mplayer.Wait()
+		}
+		out.Close()
+		close(exited)
+		p.mu.Lock()
+		if ffmpeg != nil && ffmpeg.Process != nil {
+			_ = ffmpeg.Process.Kill()
+		}
+		if ctx.Err() != nil { // остановлен через stop
+			p.mu.Unlock()
+			return
+		}
+		file := p.current
+		p.ffmpeg, p.mplayer, p.exited, p.current, p.ipc = nil, nil, nil, "", nil
+		p.mu.Unlock()
+		p.plays.end("crash", time.Now())
+
+		if time.Since(started) >= playerStableAfter {
+			failures = 0
+		}
+		failures++
+		delay := min(playerRestartMin<<min(failures-1, 10), playerRestartMax)
+		if p.crashed(file, len(run) > 1, time.Now()) {
+			failures, delay = 0, playerRestartMin // без проблемного файла можно сразу
+		}
+		p.mu.Lock()
+		total := p.crashes
+		p.mu.Unlock()
+		attrs := []any{"player", videoPlayerCmd, "err", err, "crashes", total, "retry_in", delay.String()}
+		if file != "" {
+			attrs = append(attrs, "file", filepath.Base(file), "media_id", mediaIDForFile(file))
+		}
+		logPlayer.Error("плеер завершился сам", attrs...)
+		clearDisplayBlack() // пока ждём — чёрный экран, а не консоль
+		if !sleepCtx(ctx, delay) {
+			return
+		}
+		setDisplayResolution1280x720() // X мог перезапуститься
+		p.mu.Lock()
+		p.restarts++
+		p.mu.Unlock()
+	}
+}
+
+// attachIPC подключается к сокету только что запущенного mpv и держит p.ipc, пока процесс жив.
+func (p *player) attachIPC(ctx context.Context, cmd *exec.Cmd, exited <-chan struct{}) {
+	ipc, err := dialMPV(ctx, statePath(mpvSocket), p.mpvEvent)
+	if err != nil {
+		if ctx.Err() == nil {
+			logPlayer.Warn("mpv IPC недоступен, плейлист будет меняться перезапуском", "err", err)
+		}
+		return
+	}
+	defer ipc.Close()
+	if _, err := ipc.command("observe_property", 1, "path"); err != nil {
+		logPlayer.Warn("mpv IPC: observe_property path не удался", "err", err)
+	}
+	p.mu.Lock()
+	if p.mplayer != cmd {
+		p.mu.Unlock()
+		return
+	}
+	p.ipc = ipc
+	p.mu.Unlock()
+	select {
+	case <-exited:
+	case <-ipc.closed:
+	}
+	p.mu.Lock()
+	if p.ipc == ipc {
+		p.ipc = nil
+	}
+	p.mu.Unlock()
+}
+
+// mpvEvent обрабатывает события mpv: смена свойства path — начал играть другой файл;
+// file-loaded и end-file — начало и конец показа (файл, повторённый по кругу, тоже даёт file-loaded).
+func (p *player) mpvEvent(ev mpvMessage) {
+	now := time.Now()
+	switch ev.Event {
+	case "property-change":
+		var path string
+		if ev.Name == "path" && json.Unmarshal(ev.Data, &path) == nil && path != "" {
+			p.setCurrent(path)
+		}
+	case "file-loaded":
+		// событие приходит из горутины чтения сокета — ответ на get_property ждём в отдельной
+		go func() {
+			var path string
+			if data, err := p.ipcCommand("get_property", "path"); err == nil && json.Unmarshal(data, &path) == nil {
+				p.plays.start(path, now)
+			}
+		}()
+	case "end-file":
+		p.plays.end(ev.Reason, now)
+	}
+}
+
+// ipcCommand выполняет команду mpv через IPC; для mplayer и до подключения к mpv — ошибка.
+func (p *player) ipcCommand(args ...any) (json.RawMessage, error) {
+	p.mu.Lock()
+	ipc := p.ipc
+	p.mu.Unlock()
+	if ipc == nil {
+		return nil, fmt.Errorf("управление без перезапуска доступно только для mpv с IPC")
+	}
+	return ipc.command(args...)
+}
+
+// next переключает на следующий файл плейлиста.
+func (p *player) next() error {
+	_, err := p.ipcCommand("playlist-next", "force")
+	return err
+}
+
+// setPaused ставит воспроизведение на паузу или снимает с неё.
+func (p *player) setPaused(paused bool) error {
+	_, err := p.ipcCommand("set_property", "pause", paused)
+	return err
+}
+
+// setVolume меняет громкость mpv на лету (для следующих запусков она берётся из playerVolume).
+func (p *player) setVolume(vol int32) error {
+	_, err := p.ipcCommand("set_property", "volume", vol)
+	return err
+}
+
+// currentFile возвращает файл, который сейчас играет: у mpv — по IPC, иначе — по выводу плеера.
+func (p *player) currentFile() string {
+	if data, err := p.ipcCommand("get_property", "path"); err == nil {
+		var path string
+		if json.Unmarshal(data, &path) == nil && path != "" {
+			return path
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current
+}
+
+// setCurrent запоминает файл, который плеер начал играть.
+func (p *player) setCurrent(path string) {
+	p.mu.Lock()
+	p.current = path
+	p.mu.Unlock()
+}
+
+// playing — плеер сообщил в выводе, что начал файл path. Показы mpv с IPC считаются по событиям
+// IPC (см. mpvEvent), остальные — по выводу.
+func (p *player) playing(path string) {
+	p.mu.Lock()
+	p.current = path
+	viaIPC := p.ipc != nil
+	p.mu.Unlock()
+	if !viaIPC {
+		p.plays.start(path, time.Now())
+	}
+}
+
+// crashed учитывает падение плеера на файле file ("" — файл неизвестен) и отправляет файл в карантин,
+// если за quarantineWindow на нём было quarantineCrashes падений. Последний играбельный файл (canQuarantine=false)
+// не убираем: лучше перезапуски с задержкой, чем чёрный экран. Возвращает true, если файл ушёл в карантин.
+func (p *player) crashed(file string, canQuarantine bool, now time.Time) bool {
+	p.mu.Lock()
+	p.crashes++
+	if file == "" {
+		p.mu.Unlock()
+		return false
+	}
+	if p.fileCrashes == nil {
+		p.fileCrashes = map[string][]time.Time{}
+	}
+	var recent []time.Time
+	for _, t := range p.fileCrashes[file] {
+		if now.Sub(t) < quarantineWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < quarantineCrashes || !canQuarantine {
+		p.fileCrashes[file] = recent
+		p.mu.Unlock()
+		return false
+	}
+	delete(p.fileCrashes, file)
+	p.mu.Unlock()
+	if err := addToQuarantine(file, len(recent), now); err != nil {
+		logPlayer.Error("файл не помещён в карантин", "file", file, "err", err)
+		return false
+	}
+	logPlayer.Warn("файл в карантине: плеер на нём падает", "file", filepath.Base(file), "media_id", mediaIDForFile(file),
+		"crashes", len(recent), "window", quarantineWindow.String(), "ttl", quarantineTTL.String())
+	return true
+}
+
+// playerStats — состояние плеера и счётчики супервизора для логов и телеметрии.
+type playerStats struct {
+	Name        string `json:"name"`              // mpv или mplayer
+	State       string `json:"state"`             // playing, paused, restarting (ждёт перезапуска после падения), stopped
+	Current     string `json:"current,omitempty"` // файл в MEDIA_DIR
+	MediaID     string `json:"mediaId,omitempty"`
+	Playlist    int    `json:"playlist"` // элементов в текущем плейлисте
+	Crashes     int    `json:"crashes"`
+	Restarts    int    `json:"restarts"`
+	Quarantined int    `json:"quarantined"`
+}
+
+func (p *player) stats() playerStats {
+	q := len(loadQuarantine(time.Now()))
+	current := p.currentFile()
+	var paused bool
+	if data, err := p.ipcCommand("get_property", "pause"); err == nil {
+		_ = json.Unmarshal(data, &paused)
+	}
+	p.mu.Lock()
+	ps := playerStats{Name: videoPlayerCmd, Playlist: len(p.entries), Crashes: p.crashes, Restarts: p.restarts, Quarantined: q}
+	switch {
+	case p.cancel == nil:
+		ps.State = "stopped"
+	case p.mplayer == nil:
+		ps.State = "restarting"
+	case paused:
+		ps.State = "paused"
+	default:
+		ps.State = "playing"
+	}
+	p.mu.Unlock()
+	if current != "" && ps.State != "stopped" {
+		ps.Current, ps.MediaID = filepath.Base(current), mediaIDForFile(current)
+	}
+	return ps
+}
+
+// stop завершает плеер вместе с его группой процессов и заливает экран чёрным.
+func (p *player) stop() {
+	p.mu.Lock()
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+	mplayer, ffmpeg, exited := p.mplayer, p.ffmpeg, p.exited
+	p.ffmpeg, p.mplayer, p.exited, p.entries, p.current, p.ipc = nil, nil, nil, nil, "", nil
+	p.mu.Unlock()
+	p.plays.end("stop", time.Now())
+	if mplayer != nil && mplayer.Process != nil {
+		terminateGroup(mplayer.Process.Pid, exited)
+	}
+	if ffmpeg != nil && ffmpeg.Process != nil {
+		_ = ffmpeg.Process.Kill()
+	}
+	clearDisplayBlack() // сразу чёрный экран, чтобы не мелькала консоль
+}
+
+// terminateGroup посылает SIGTERM группе процессов pid (плеер запускается с Setpgid, чтобы
+// не осталось дочерних процессов), ждёт exited до playerStopTimeout и добивает SIGKILL.
+func terminateGroup(pid int, exited <-chan struct{}) {
+	_ = syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(playerStopTimeout):
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+		<-exited
+	}
+}
+
+// sleepCtx ждёт d; false — ctx отменён раньше.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// playerOutput пишет вывод плеера в лог и по строкам "Playing: файл" (mpv) / "Playing файл." (mplayer)
+// сообщает, какой файл начал играть.
+type playerOutput struct {
+	log     *rotatingLog // nil — лог не открылся, вывод только разбирается
+	playing func(path string)
+	line    []byte
+}
+
+func newPlayerOutput(logPath string, playing func(path string)) *playerOutput {
+	l, err := openLog(logPath)
+	if err != nil {
+		l = nil
+	}
+	return &playerOutput{log: l, playing: playing}
+}
+
+func (o *playerOutput) Write(b []byte) (int, error) {
+	if o.log != nil {
+		_, _ = o.log.Write(b)
+	}
+	o.line = append(o.line, b...)
+	for {
+		i := bytes.IndexAny(o.line, "\r\n")
+		if i < 0 {
+			break
+		}
+		o.parse(string(o.line[:i]))
+		o.line = o.line[i+1:]
+	}
+	if len(o.line) > 4096 { // строка без перевода — не наш случай, не копим
+		o.line = nil
+	}
+	o.line = append([]byte(nil), o.line...)
+	return len(b), nil
+}
+
+func (o *playerOutput) parse(line string) {
+	var path string
+	switch {
+	case strings.HasPrefix(line, "Playing: "):
+		path = strings.TrimPrefix(line, "Playing: ")
+	case strings.HasPrefix(line, "Playing "):
+		path = strings.TrimSuffix(strings.TrimPrefix(line, "Playing "), ".")
+	default:
+		return
+	}
+	o.playing(strings.TrimPrefix(path, "mf://"))
+}
+
+func (o *playerOutput) Close() error {
+	if o.log == nil {
+		return nil
+	}
+	return o.log.Close()
+}
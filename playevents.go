@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	playEventsPath = "/device/me/play-events"
+	// playEventsFile — очередь событий показа (JSON Lines) в каталоге состояния; переживает перезапуск и отсутствие сети.
+	playEventsFile = "play-events.jsonl"
+	// playEventsInterval — как часто отправлять очередь на сервер.
+	playEventsInterval = 5 * time.Minute
+	// playEventsBatch — событий в одном запросе.
+	playEventsBatch = 500
+	// playEventsMax — больше событий не храним (при долгом офлайне отбрасываются самые старые).
+	playEventsMax = 100000
+)
+
+// playEvent — один показ медиа: когда начался и закончился. ID уникален, чтобы сервер отбрасывал
+// повторы, если ответ на отправку потерялся и пачка ушла ещё раз.
+type playEvent struct {
+	ID        string    `json:"id"`
+	MediaID   string    `json:"mediaId"`
+	File      string    `json:"file"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	Duration  float64   `json:"duration"`  // секунды
+	EndReason string    `json:"endReason"` // eof, stop, error, crash...
+}
+
+// playLog отслеживает текущий показ и по его окончании ставит событие в очередь.
+type playLog struct {
+	mu   sync.Mutex
+	open *playEvent
+}
+
+// start отмечает начало показа файла path; предыдущий показ, если не закрыт, считается досмотренным.
+// Повторный start того же файла в пределах секунды — тот же показ (о нём сообщили и вывод плеера, и IPC).
+func (l *playLog) start(path string, now time.Time) {
+	if path == "" {
+		return
+	}
+	l.mu.Lock()
+	if l.open != nil && l.open.File == filepath.Base(path) && now.Sub(l.open.StartedAt) < time.Second {
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+	l.end("eof", now)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open = &playEvent{MediaID: mediaIDForFile(path), File: filepath.Base(path), StartedAt: now}
+}
+
+// end закрывает текущий показ с причиной reason и записывает его в очередь.
+func (l *playLog) end(reason string, now time.Time) {
+	l.mu.Lock()
+	ev := l.open
+	l.open = nil
+	l.mu.Unlock()
+	if ev == nil {
+		return
+	}
+	ev.ID = newEventID()
+	ev.EndedAt = now
+	ev.Duration = now.Sub(ev.StartedAt).Round(time.Millisecond).Seconds()
+	ev.EndReason = reason
+	if err := appendPlayEvent(*ev); err != nil {
+		logReport.Error("событие показа не записано", "media_id", ev.MediaID, "err", err)
+	}
+}
+
+// mediaIDForFile находит id медиа по файлу через манифест; без манифеста — имя файла без расширения.
+func mediaIDForFile(path string) string {
+	key := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if e, ok := loadManifest().Files[key]; ok && e.ID != "" {
+		return e.ID
+	}
+	return key
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// appendPlayEvent дописывает событие в конец очереди и сбрасывает файл на диск.
+func appendPlayEvent(ev playEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockState(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(statePath(playEventsFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readPlayEvents возвращает строки очереди (каждая — JSON одного события).
+func readPlayEvents() ([][]byte, error) {
+	unlock, err := lockState(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	f, err := os.Open(statePath(playEventsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines [][]byte
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := bytes.TrimSpace(sc.Bytes()); json.Valid(line) {
+			lines = append(lines, append([]byte(nil), line...))
+		}
+	}
+	return lines, sc.Err()
+}
+
+// dropPlayEvents удаляет из начала очереди n отправленных событий. События, дописанные
+// во время отправки, остаются: они идут после первых n строк.
+func dropPlayEvents(n int) error {
+	unlock, err := lockState(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	b, err := os.ReadFile(statePath(playEventsFile))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n && len(b) > 0; {
+		line, tail, _ := bytes.Cut(b, []byte("\n"))
+		b = tail
+		if json.Valid(bytes.TrimSpace(line)) {
+			i++
+		}
+	}
+	return writeFileAtomic(statePath(playEventsFile), b, 0644)
+}
+
+// uploadPlayEvents отправляет очередь пачками по playEventsBatch на POST /device/me/play-events.
+// Событие удаляется из очереди только после ответа 2xx.
+func uploadPlayEvents(au *auth) error {
+	lines, err := readPlayEvents()
+	if err != nil {
+		return err
+	}
+	if over := len(lines) - playEventsMax; over > 0 {
+		logReport.Warn("очередь показов переполнена, отбрасываю старые события", "dropped", over)
+		if err := dropPlayEvents(over); err != nil {
+			return err
+		}
+		lines = lines[over:]
+	}
+	for len(lines) > 0 {
+		n := min(len(lines), playEventsBatch)
+		body := append([]byte(`{"events":[`), bytes.Join(lines[:n], []byte(","))...)
+		body = append(body, "]}"...)
+		err := au.do(func(jwt string) error {
+			req, err := http.NewRequest(http.MethodPost, au.serverURL+playEventsPath, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+jwt)
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusUnauthorized {
+				return errUnauthorized
+			}
+			if resp.StatusCode/100 != 2 {
+				bs, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+				return fmt.Errorf("play-events %d: %s", resp.StatusCode, string(bs))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := dropPlayEvents(n); err != nil {
+			return err
+		}
+		logReport.Info("показы отправлены", "events", n)
+		lines = lines[n:]
+	}
+	return nil
+}
+
+// runPlayEventsUpload отправляет очередь показов каждые playEventsInterval, пока не отменён ctx.
+func runPlayEventsUpload(ctx context.Context, au *auth) {
+	ticker := time.NewTicker(playEventsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if jwt, _ := loadJWT(); jwt == "" {
+			continue
+		}
+		if err := uploadPlayEvents(au); err != nil {
+			logReport.Error("показы не отправлены", "err", err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultImageDuration — сколько секунд показывать картинку, если в MediaItem нет duration.
+const defaultImageDuration = 10
+
+// videoExts, imageExts и audioExts — расширения, которые отдаём плееру (см. mediaTypes).
+var (
+	videoExts = []string{".mkv", ".mp4", ".avi", ".webm", ".mov", ".m4v", ".ts", ".mpg"}
+	imageExts = []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}
+	audioExts = []string{".mp3", ".m4a", ".ogg", ".flac", ".wav"}
+)
+
+// playlistEntry — один элемент плейлиста плеера.
+type playlistEntry struct {
+	Path string
+	// MaxDuration — сколько секунд показывать файл (0 — до конца); для картинок — время показа
+	MaxDuration float64
+	Image       bool
+}
+
+// isImageFile сообщает, картинка ли это (по расширению).
+func isImageFile(path string) bool {
+	return hasExt(path, imageExts)
+}
+
+func hasExt(path string, exts []string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// imageDuration — время показа картинки по умолчанию: IMAGE_DURATION (секунды) или defaultImageDuration.
+func imageDuration() float64 {
+	if v, err := strconv.ParseFloat(configValue("IMAGE_DURATION"), 64); err == nil && v > 0 {
+		return v
+	}
+	return defaultImageDuration
+}
+
+// newEntry делает элемент плейлиста для файла path; для картинок задаёт время показа.
+func newEntry(path string, it MediaItem) playlistEntry {
+	e := playlistEntry{Path: path, MaxDuration: it.MaxDuration}
+	if isImageFile(path) {
+		e.Image = true
+		switch {
+		case it.Duration > 0:
+			e.MaxDuration = it.Duration
+		case e.MaxDuration <= 0:
+			e.MaxDuration = imageDuration()
+		}
+	}
+	return e
+}
+
+// sortByOrder упорядочивает items по полю order; при равных order сохраняется порядок сервера.
+func sortByOrder(items []MediaItem) []MediaItem {
+	sorted := append([]MediaItem(nil), items...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Order < sorted[j].Order })
+	return sorted
+}
+
+// buildPlaylist строит плейлист из items: порядок по order, каждый элемент повторяется repeat раз.
+// path возвращает путь к файлу элемента или "", если файла нет.
+func buildPlaylist(items []MediaItem, path func(MediaItem) string) []playlistEntry {
+	var entries []playlistEntry
+	for _, it := range sortByOrder(items) {
+		p := path(it)
+		if p == "" {
+			continue
+		}
+		n := it.Repeat
+		if n < 1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			entries = append(entries, newEntry(p, it))
+		}
+	}
+	return entries
+}
+
+// filesPlaylist превращает список файлов в плейлист: видео до конца, картинки — imageDuration().
+func filesPlaylist(files []string) []playlistEntry {
+	entries := make([]playlistEntry, 0, len(files))
+	for _, f := range files {
+		entries = append(entries, newEntry(f, MediaItem{}))
+	}
+	return entries
+}
+
+// formatSeconds форматирует длительность для аргументов плеера (без лишних нулей).
+func formatSeconds(sec float64) string {
+	return strconv.FormatFloat(sec, 'f', -1, 64)
+}
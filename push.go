@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	eventsPath     = "/device/me/events"
+	screenshotPath = "/device/me/screenshot"
+
+	// pushIdleTimeout — если сервер столько молчит (даже без keep-alive комментариев), переподключаемся:
+	// на LTE соединение часто «зависает» без разрыва.
+	pushIdleTimeout = 3 * time.Minute
+	pushMaxBackoff  = 5 * time.Minute
+)
+
+// Команды канала событий.
+const (
+	cmdSync          = "sync"
+	cmdReboot        = "reboot"
+	cmdRestartPlayer = "restart-player"
+	cmdScreenshot    = "screenshot"
+	cmdVolume        = "volume"
+	cmdNext          = "next"   // следующий файл (mpv)
+	cmdPause         = "pause"  // пауза (mpv)
+	cmdResume        = "resume" // снять с паузы (mpv)
+)
+
+// pushCommand — команда сервера: событие SSE с JSON {"command": "...", "value": ...}
+// или событие с именем команды (event: sync) без данных.
+type pushCommand struct {
+	ID      string          `json:"id,omitempty"`
+	Command string          `json:"command"`
+	Value   json.RawMessage `json:"value,omitempty"`
+}
+
+// playerVolume — громкость 0..100 для следующего запуска плеера; -1 — не задана.
+var playerVolume atomic.Int32
+
+func init() { playerVolume.Store(-1) }
+
+// runPushChannel держит долгоживущее SSE-соединение GET /device/me/events с JWT и передаёт
+// команды в handle. При обрыве переподключается с экспоненциальной задержкой, на 401 — обновляет токен.
+// Завершается с отменой ctx.
+func runPushChannel(ctx context.Context, au *auth, handle func(pushCommand)) {
+	backoff := time.Second
+	for {
+		if jwt, _ := loadJWT(); jwt == "" {
+			if !sleepCtx(ctx, 30*time.Second) { // ждём чек-ина
+				return
+			}
+			continue
+		}
+		var connected bool
+		err := au.do(func(jwt string) (err error) {
+			connected, err = pushSession(ctx, au.serverURL, jwt, handle)
+			return err
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = time.Second // соединение было установлено — начинаем задержки заново
+		}
+		// ±20% к задержке, чтобы устройства не переподключались синхронно после сбоя сервера
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/5*2+1)) - backoff/5
+		if err != nil {
+			logPush.Warn("канал команд разорван", "err", err, "retry_in", wait.String())
+		}
+		if !sleepCtx(ctx, wait) {
+			return
+		}
+		if backoff *= 2; backoff > pushMaxBackoff {
+			backoff = pushMaxBackoff
+		}
+	}
+}
+
+// pushSession — одно подключение к каналу событий; connected=true, если сервер ответил 200.
+func pushSession(parent context.Context, serverURL, jwt string, handle func(pushCommand)) (connected bool, err error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+eventsPath, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return false, errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, fmt.Errorf("events %d: %s", resp.StatusCode, string(bs))
+	}
+	logPush.Info("канал команд подключён")
+
+	idle := time.AfterFunc(pushIdleTimeout, cancel)
+	defer idle.Stop()
+	var event string
+	var data []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		idle.Reset(pushIdleTimeout)
+		line := sc.Text()
+		switch {
+		case line == "":
+			if cmd, ok := parsePushEvent(event, strings.Join(data, "\n")); ok {
+				logPush.Info("команда", "command", cmd.Command, "id", cmd.ID)
+				handle(cmd)
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// комментарий / keep-alive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := sc.Err(); err != nil && ctx.Err() == nil {
+		return true, err
+	}
+	return true, fmt.Errorf("соединение закрыто")
+}
+
+// parsePushEvent собирает команду из события SSE.
+func parsePushEvent(event, data string) (pushCommand, bool) {
+	var cmd pushCommand
+	if strings.TrimSpace(data) != "" {
+		if err := json.Unmarshal([]byte(data), &cmd); err != nil {
+			logPush.Warn("непонятное событие", "data", data, "err", err)
+			return cmd, false
+		}
+	}
+	if cmd.Command == "" && event != "" && event != "message" {
+		cmd.Command = event
+	}
+	return cmd, cmd.Command != ""
+}
+
+// rebootDevice перезагружает устройство.
+func rebootDevice() {
+	if err := exec.Command("systemctl", "reboot").Run(); err != nil {
+		if err := exec.Command("reboot").Run(); err != nil {
+			logPush.Error("перезагрузка не удалась", "err", err)
+		}
+	}
+}
+
+// setVolume выставляет громкость 0..100 в ALSA (amixer) и запоминает её для следующего запуска плеера.
+// ok=false — значение не разобрано.
+func setVolume(raw json.RawMessage) (vol int32, ok bool) {
+	var v float64
+	if err := json.Unmarshal(raw, &v); err != nil {
+		// допускаем и строку: "value": "70"
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			logPush.Warn("громкость: непонятное значение", "value", string(raw))
+			return 0, false
+		}
+		if v, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64); err != nil {
+			logPush.Warn("громкость: непонятное значение", "value", s)
+			return 0, false
+		}
+	}
+	vol = int32(min(max(v, 0), 100))
+	playerVolume.Store(vol)
+	for _, control := range []string{"Master", "PCM", "Speaker"} {
+		if exec.Command("amixer", "-q", "sset", control, fmt.Sprintf("%d%%", vol)).Run() == nil {
+			break
+		}
+	}
+	logPush.Info("громкость изменена", "volume", vol)
+	return vol, true
+}
+
+// takeScreenshot снимает экран через ffmpeg (x11grab или /dev/fb0) и отправляет PNG
+// на POST /device/me/screenshot.
+func takeScreenshot(au *auth) error {
+	out := statePath("screenshot.png")
+	defer os.Remove(out)
+	var cmd *exec.Cmd
+	if disp := mplayerDisplay(); disp != "" && mplayerVideoOutput() == "x11" {
+		cmd = exec.Command("ffmpeg", "-y", "-loglevel", "error", "-f", "x11grab", "-i", disp, "-frames:v", "1", out)
+		cmd.Env = append(os.Environ(), "DISPLAY="+disp)
+		if xauth := xauthPath(); xauth != "" {
+			cmd.Env = append(cmd.Env, "XAUTHORITY="+xauth)
+		}
+	} else {
+		cmd = exec.Command("ffmpeg", "-y", "-loglevel", "error", "-f", "fbdev", "-i", "/dev/fb0", "-frames:v", "1", out)
+	}
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(b)))
+	}
+	img, err := os.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	return au.do(func(jwt string) error {
+		req, err := http.NewRequest(http.MethodPost, au.serverURL+screenshotPath, bytes.NewReader(img))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "image/png")
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			return errUnauthorized
+		}
+		if resp.StatusCode/100 != 2 {
+			bs, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("screenshot %d: %s", resp.StatusCode, string(bs))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+const (
+	quarantineFile = "quarantine.json"
+	// quarantineCrashes падений плеера на одном файле за quarantineWindow — файл в карантин.
+	quarantineCrashes = 3
+	quarantineWindow  = time.Hour
+	// quarantineTTL — через столько файл пробуем снова (или раньше, если он перекачан).
+	quarantineTTL = 24 * time.Hour
+	// quarantineRecheck — как часто проверять, не вышло ли что-то из карантина, если играть нечего.
+	quarantineRecheck = 10 * time.Minute
+)
+
+// quarantineEntry — файл, на котором плеер падал. Size и ModTime — чтобы отпустить файл,
+// когда синхронизация заменит его новой версией.
+type quarantineEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Since   time.Time `json:"since"`
+	Crashes int       `json:"crashes"`
+}
+
+// loadQuarantine читает STATE_DIR/quarantine.json и возвращает действующие записи (путь → запись):
+// без истёкших, удалённых и заменённых файлов.
+func loadQuarantine(now time.Time) map[string]quarantineEntry {
+	q := map[string]quarantineEntry{}
+	unlock, err := lockState(false)
+	if err != nil {
+		return q
+	}
+	b, err := os.ReadFile(statePath(quarantineFile))
+	unlock()
+	if err != nil {
+		return q
+	}
+	if err := json.Unmarshal(b, &q); err != nil {
+		logPlayer.Error("карантин не читается", "file", quarantineFile, "err", err)
+		return map[string]quarantineEntry{}
+	}
+	for path, e := range q {
+		st, err := os.Stat(path)
+		if err != nil || now.Sub(e.Since) >= quarantineTTL || st.Size() != e.Size || !st.ModTime().Equal(e.ModTime) {
+			delete(q, path)
+		}
+	}
+	return q
+}
+
+// addToQuarantine записывает файл path в карантин.
+func addToQuarantine(path string, crashes int, now time.Time) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	q := loadQuarantine(now)
+	q[path] = quarantineEntry{Size: st.Size(), ModTime: st.ModTime(), Since: now, Crashes: crashes}
+	b, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	unlock, err := lockState(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(statePath(quarantineFile), b, 0644)
+}
+
+// playableEntries убирает из плейлиста файлы в карантине.
+func playableEntries(entries []playlistEntry, now time.Time) []playlistEntry {
+	q := loadQuarantine(now)
+	if len(q) == 0 {
+		return entries
+	}
+	var out []playlistEntry
+	for _, e := range entries {
+		if _, bad := q[e.Path]; !bad {
+			out = append(out, e)
+		}
+	}
+	return out
+}
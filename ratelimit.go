@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateChunk — сколько байт читаем за раз из ответа при ограничении скорости: чем меньше,
+// тем ровнее поток, но больше вызовов. При низкой скорости кусок — не больше секунды трафика,
+// чтобы ожидание между чтениями не выглядело как зависшее соединение (downloadIdleTimeout).
+const rateChunk = 32 << 10
+
+// rateWindow — ограничение скорости загрузки в интервале суток (DOWNLOAD_RATE_SCHEDULE).
+type rateWindow struct {
+	Start, End int   // минуты от начала суток; Start > End — интервал через полночь
+	Rate       int64 // байт/с, 0 — без ограничения
+}
+
+// ratePolicy — ограничение скорости всех загрузок вместе: Rate (DOWNLOAD_RATE_LIMIT), если время
+// не попадает ни в одно окно Windows.
+type ratePolicy struct {
+	Rate    int64
+	Windows []rateWindow
+}
+
+// rateAt возвращает ограничение в момент t (байт/с, 0 — без ограничения).
+func (p ratePolicy) rateAt(t time.Time) int64 {
+	mins := t.Hour()*60 + t.Minute()
+	for _, w := range p.Windows {
+		if (w.Start <= w.End && mins >= w.Start && mins < w.End) || (w.Start > w.End && (mins >= w.Start || mins < w.End)) {
+			return w.Rate
+		}
+	}
+	return p.Rate
+}
+
+// parseRateSchedule разбирает "07:00-10:00=256K,22:00-06:00=0": интервалы суток с ограничением
+// в байтах в секунду; первое подходящее окно важнее остальных.
+func parseRateSchedule(s string) ([]rateWindow, error) {
+	var out []rateWindow
+	for _, part := range splitList(s) {
+		span, rate, ok := strings.Cut(part, "=")
+		start, end, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("DOWNLOAD_RATE_SCHEDULE: %q: ожидается HH:MM-HH:MM=скорость", part)
+		}
+		var w rateWindow
+		var err error
+		if w.Start, err = parseClock(strings.TrimSpace(start), 0); err != nil {
+			return nil, fmt.Errorf("DOWNLOAD_RATE_SCHEDULE: %w", err)
+		}
+		if w.End, err = parseClock(strings.TrimSpace(end), 0); err != nil {
+			return nil, fmt.Errorf("DOWNLOAD_RATE_SCHEDULE: %w", err)
+		}
+		if w.Rate, ok = parseSize(rate); !ok {
+			return nil, fmt.Errorf("DOWNLOAD_RATE_SCHEDULE: %q: ожидается скорость, например 512K", rate)
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// rateLimiter — token bucket на все загрузки сразу: сколько бы файлов ни качалось параллельно,
+// вместе они не превышают ограничения. Запас — не больше секунды трафика.
+type rateLimiter struct {
+	mu     sync.Mutex
+	policy ratePolicy
+	tokens float64
+	last   time.Time
+}
+
+// downloadLimiter ограничивает скорость всех загрузок медиа (настройки — из config, меняются по SIGHUP).
+var downloadLimiter rateLimiter
+
+// chunk — сколько байт читать за раз при текущем ограничении.
+func (l *rateLimiter) chunk() int {
+	l.mu.Lock()
+	rate := l.policy.rateAt(time.Now())
+	l.mu.Unlock()
+	if rate <= 0 {
+		return rateChunk
+	}
+	return int(min(max(rate, 1<<10), rateChunk))
+}
+
+func (l *rateLimiter) setPolicy(p ratePolicy) {
+	l.mu.Lock()
+	l.policy = p
+	l.mu.Unlock()
+}
+
+// wait списывает n байт и, если запас ушёл в минус, ждёт, пока он восполнится.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	rate := l.policy.rateAt(now)
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		l.mu.Unlock()
+		return nil
+	}
+	if !l.last.IsZero() {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(rate), float64(rate))
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := -l.tokens
+	l.mu.Unlock()
+	if debt <= 0 {
+		return nil
+	}
+	if !sleepCtx(ctx, time.Duration(debt/float64(rate)*float64(time.Second))) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// limitedReader читает r не быстрее, чем позволяет l.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rateLimiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	if c := r.l.chunk(); len(b) > c {
+		b = b[:c]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		if werr := r.l.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRateSchedule(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []rateWindow
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"07:00-10:00=256K", []rateWindow{{7 * 60, 10 * 60, 256 << 10}}, false},
+		{"07:00-10:00=256K, 22:00-06:00=0", []rateWindow{{7 * 60, 10 * 60, 256 << 10}, {22 * 60, 6 * 60, 0}}, false},
+		{"07:00-10:00", nil, true},
+		{"07:00=1M", nil, true},
+		{"7am-10:00=1M", nil, true},
+		{"07:00-25:00=1M", nil, true},
+		{"07:00-10:00=fast", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateSchedule(tt.s)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRateSchedule(%q) = %v, %v; want %v, err=%v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRateAt(t *testing.T) {
+	p := ratePolicy{
+		Rate: 1 << 20,
+		Windows: []rateWindow{
+			{Start: 7 * 60, End: 10 * 60, Rate: 256 << 10},
+			{Start: 9 * 60, End: 12 * 60, Rate: 512 << 10},
+			{Start: 22 * 60, End: 6 * 60, Rate: 0},
+		},
+	}
+	at := func(hour, min int) time.Time { return time.Date(2026, 1, 5, hour, min, 0, 0, time.Local) }
+	tests := []struct {
+		t    time.Time
+		want int64
+	}{
+		{at(6, 59), 1 << 20},
+		{at(7, 0), 256 << 10},
+		{at(9, 30), 256 << 10}, // первое подходящее окно важнее
+		{at(10, 0), 512 << 10},
+		{at(12, 0), 1 << 20},
+		{at(23, 0), 0},
+		{at(0, 0), 0},
+		{at(5, 59), 0},
+		{at(6, 0), 1 << 20},
+	}
+	for _, tt := range tests {
+		if got := p.rateAt(tt.t); got != tt.want {
+			t.Errorf("rateAt(%s) = %d, want %d", tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// scheduleWindow — окно показа (dayparting). Все поля необязательные; пустое окно действует всегда.
+type scheduleWindow struct {
+	// Days — дни недели: 1 — понедельник ... 7 — воскресенье; пусто — все дни
+	Days []int `json:"days,omitempty"`
+	// Start, End — "HH:MM" по местному времени устройства; End раньше Start — окно через полночь
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// From, To — "YYYY-MM-DD", даты включительно
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// activeAt сообщает, попадает ли t в окно. Для окна через полночь день недели и даты
+// проверяются по дню, в который окно началось.
+func (w scheduleWindow) activeAt(t time.Time) bool {
+	start, err := parseClock(w.Start, 0)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(w.End, 24*60)
+	if err != nil {
+		return false
+	}
+	mins := t.Hour()*60 + t.Minute()
+	day := t
+	switch {
+	case start <= end:
+		if mins < start || mins >= end {
+			return false
+		}
+	case mins >= start:
+	case mins < end:
+		day = t.AddDate(0, 0, -1)
+	default:
+		return false
+	}
+	return w.dayMatches(day)
+}
+
+func (w scheduleWindow) dayMatches(day time.Time) bool {
+	if len(w.Days) > 0 {
+		wd := int(day.Weekday())
+		if wd == 0 {
+			wd = 7
+		}
+		found := false
+		for _, d := range w.Days {
+			if d == wd {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	date := day.Format("2006-01-02")
+	if w.From != "" && date < w.From {
+		return false
+	}
+	if w.To != "" && date > w.To {
+		return false
+	}
+	return true
+}
+
+// validate проверяет поля окна: с ошибкой в расписании окно никогда не совпало бы с текущим временем.
+func (w scheduleWindow) validate() error {
+	if _, err := parseClock(w.Start, 0); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if _, err := parseClock(w.End, 24*60); err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	for _, d := range w.Days {
+		if d < 1 || d > 7 {
+			return fmt.Errorf("days: %d — ожидается от 1 (понедельник) до 7 (воскресенье)", d)
+		}
+	}
+	for _, date := range []string{w.From, w.To} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			return fmt.Errorf("дата %q: ожидается YYYY-MM-DD", date)
+		}
+	}
+	return nil
+}
+
+// validSchedules убирает из расписаний окна с ошибками (с записью в лог). Элемент, у которого не
+// осталось ни одного окна, пропускается: без расписания он играл бы всегда, а не тогда, когда задумано.
+func validSchedules(items []MediaItem) []MediaItem {
+	out := items[:0]
+	for _, it := range items {
+		if len(it.Schedule) == 0 {
+			out = append(out, it)
+			continue
+		}
+		var windows []scheduleWindow
+		for _, w := range it.Schedule {
+			if err := w.validate(); err != nil {
+				logSync.Error("окно расписания с ошибкой пропущено", "media_id", it.ID, "name", it.Name, "err", err)
+				continue
+			}
+			windows = append(windows, w)
+		}
+		if len(windows) == 0 {
+			logSync.Error("у элемента нет ни одного правильного окна расписания, пропускаю его", "media_id", it.ID, "name", it.Name)
+			continue
+		}
+		it.Schedule = windows
+		out = append(out, it)
+	}
+	return out
+}
+
+// parseClock переводит "HH:MM" в минуты от начала суток; пустая строка — def.
+func parseClock(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || h > 24 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("время %q: ожидается HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// activeAt сообщает, должен ли элемент играть в момент t: без расписания — всегда,
+// иначе — если t попадает хотя бы в одно окно.
+func (it MediaItem) activeAt(t time.Time) bool {
+	if len(it.Schedule) == 0 {
+		return true
+	}
+	for _, w := range it.Schedule {
+		if w.activeAt(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// activeItems оставляет элементы, которые по расписанию играют в момент t.
+func activeItems(items []MediaItem, t time.Time) []MediaItem {
+	var out []MediaItem
+	for _, it := range items {
+		if it.activeAt(t) {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+// mediaPlaylist — плейлист со своим расписанием в ответе GET /device/me/media.
+type mediaPlaylist struct {
+	ID       string           `json:"id"`
+	Name     string           `json:"name"`
+	Schedule []scheduleWindow `json:"schedule,omitempty"`
+	Items    []MediaItem      `json:"items"`
+}
+
+// flattenPlaylists разворачивает плейлисты в один список: элемент без своего расписания
+// получает расписание плейлиста.
+func flattenPlaylists(playlists []mediaPlaylist) []MediaItem {
+	var items []MediaItem
+	for _, p := range playlists {
+		for _, it := range p.Items {
+			if len(it.Schedule) == 0 {
+				it.Schedule = p.Schedule
+			}
+			items = append(items, it)
+		}
+	}
+	return items
+}
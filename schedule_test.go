@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindowActiveAt(t *testing.T) {
+	// 2026-01-05 — понедельник
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 1, day, hour, min, 0, 0, time.Local) }
+	tests := []struct {
+		name string
+		w    scheduleWindow
+		t    time.Time
+		want bool
+	}{
+		{"пустое окно", scheduleWindow{}, at(5, 3, 0), true},
+		{"внутри", scheduleWindow{Start: "09:00", End: "18:00"}, at(5, 9, 0), true},
+		{"до начала", scheduleWindow{Start: "09:00", End: "18:00"}, at(5, 8, 59), false},
+		{"end не входит", scheduleWindow{Start: "09:00", End: "18:00"}, at(5, 18, 0), false},
+		{"только start", scheduleWindow{Start: "22:00"}, at(5, 23, 59), true},
+		{"end 24:00", scheduleWindow{Start: "20:00", End: "24:00"}, at(5, 23, 59), true},
+		{"через полночь, вечер", scheduleWindow{Start: "22:00", End: "06:00"}, at(5, 23, 0), true},
+		{"через полночь, утро", scheduleWindow{Start: "22:00", End: "06:00"}, at(6, 5, 59), true},
+		{"через полночь, днём", scheduleWindow{Start: "22:00", End: "06:00"}, at(5, 12, 0), false},
+		{"день недели", scheduleWindow{Days: []int{1}}, at(5, 12, 0), true},
+		{"другой день недели", scheduleWindow{Days: []int{2, 3}}, at(5, 12, 0), false},
+		{"воскресенье — 7", scheduleWindow{Days: []int{7}}, at(4, 12, 0), true},
+		// окно пятницы через полночь продолжается в субботу утром
+		{"через полночь, день начала", scheduleWindow{Days: []int{5}, Start: "22:00", End: "02:00"}, at(10, 1, 0), true},
+		{"через полночь, чужой день начала", scheduleWindow{Days: []int{6}, Start: "22:00", End: "02:00"}, at(10, 1, 0), false},
+		{"даты включительно", scheduleWindow{From: "2026-01-05", To: "2026-01-05"}, at(5, 23, 59), true},
+		{"после to", scheduleWindow{To: "2026-01-04"}, at(5, 0, 0), false},
+		{"до from", scheduleWindow{From: "2026-01-06"}, at(5, 23, 59), false},
+		{"через полночь после to", scheduleWindow{Start: "22:00", End: "02:00", To: "2026-01-05"}, at(6, 1, 0), true},
+		{"неверное время", scheduleWindow{Start: "25:00"}, at(5, 12, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.w.activeAt(tt.t); got != tt.want {
+			t.Errorf("%s: activeAt(%s) = %v, want %v", tt.name, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestValidSchedules(t *testing.T) {
+	items := []MediaItem{
+		{ID: "always"},
+		{ID: "ok", Schedule: []scheduleWindow{{Start: "09:00", End: "18:00"}}},
+		{ID: "partly", Schedule: []scheduleWindow{{Start: "9am"}, {Days: []int{1}}}},
+		{ID: "broken", Schedule: []scheduleWindow{{Days: []int{0}}, {From: "05.01.2026"}}},
+	}
+	got := validSchedules(items)
+	var ids []string
+	for _, it := range got {
+		ids = append(ids, it.ID)
+	}
+	if len(got) != 3 || got[0].ID != "always" || got[1].ID != "ok" || got[2].ID != "partly" {
+		t.Fatalf("validSchedules: %v, want [always ok partly]", ids)
+	}
+	if len(got[2].Schedule) != 1 || len(got[2].Schedule[0].Days) != 1 {
+		t.Errorf("validSchedules: у partly осталось %+v, want только окно с days", got[2].Schedule)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultStateDir — каталог для токена, манифеста, логов и служебных файлов. Задаётся STATE_DIR.
+const defaultStateDir = "/var/lib/mediaplayer"
+
+// stateDir — абсолютный путь к каталогу состояния (заполняется initStateDir).
+var stateDir string
+
+const (
+	stateLockFile = ".lock"
+	logDirName    = "log"
+)
+
+// statePath возвращает путь к файлу в каталоге состояния.
+func statePath(name string) string {
+	return filepath.Join(stateDir, name)
+}
+
+// logDir — каталог логов внутри каталога состояния.
+func logDir() string {
+	return statePath(logDirName)
+}
+
+// initStateDir создаёт каталог состояния. Файлы в нём трогаем только после acquireInstanceLock.
+func initStateDir(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(abs, logDirName), 0755); err != nil {
+		return fmt.Errorf("STATE_DIR %s: %w", abs, err)
+	}
+	stateDir = abs
+	return nil
+}
+
+// migrateState переносит в каталог состояния файлы из старых мест (.jwt из рабочего каталога,
+// манифест и логи из MEDIA_DIR).
+func migrateState(mediaDir string) error {
+	legacy := map[string]string{
+		filepath.Join(mediaDir, ".manifest.json"):      statePath(manifestFile),
+		filepath.Join(mediaDir, ".system.log"):         filepath.Join(logDir(), "system.log"),
+		filepath.Join(mediaDir, ".mpv-errors.log"):     filepath.Join(logDir(), "mpv-errors.log"),
+		filepath.Join(mediaDir, ".mplayer-errors.log"): filepath.Join(logDir(), "mplayer-errors.log"),
+	}
+	// .jwt лежал в рабочем каталоге процесса или рядом с бинарником
+	if wd, err := os.Getwd(); err == nil {
+		legacy[filepath.Join(wd, ".jwt")] = statePath(jwtFile)
+	}
+	if exe, err := os.Executable(); err == nil {
+		legacy[filepath.Join(filepath.Dir(exe), ".jwt")] = statePath(jwtFile)
+	}
+	unlock, err := lockState(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for from, to := range legacy {
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := moveFile(from, to); err != nil {
+			logState.Error("перенос не удался", "from", from, "to", to, "err", err)
+			continue
+		}
+		logState.Info("перенесён", "from", from, "to", to)
+	}
+	return nil
+}
+
+// moveFile переносит файл; между файловыми системами — копированием.
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	b, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	st, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(to, b, st.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+// lockState берёт flock на каталог состояния: exclusive — для записи, иначе общий для чтения.
+// Так два процесса не перезапишут токен и манифест друг другу наполовину.
+func lockState(exclusive bool) (unlock func(), err error) {
+	f, err := os.OpenFile(statePath(stateLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+const (
+	instanceLockFile = "mediaplayer.pid"
+	// takeoverTimeout — сколько ждать штатного завершения старого процесса при --takeover до SIGKILL
+	takeoverTimeout = 20 * time.Second
+)
+
+// acquireInstanceLock гарантирует, что работает один процесс: держит flock на STATE_DIR/mediaplayer.pid
+// (с PID внутри) до выхода. Если файл занят — ошибка с PID владельца, а при takeover старому
+// процессу отправляется SIGTERM и блокировка забирается после его завершения.
+func acquireInstanceLock(takeover bool) (release func(), err error) {
+	f, err := os.OpenFile(statePath(instanceLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("блокировка %s: %w", f.Name(), err)
+		}
+		pid := readPID(f)
+		if !takeover {
+			f.Close()
+			return nil, fmt.Errorf("mediaplayer уже запущен (PID %d, блокировка %s). Остановите его (systemctl stop mediaplayer) или запустите с --takeover", pid, f.Name())
+		}
+		if err := takeOver(f, pid); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return func() {
+		_ = f.Truncate(0)
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// takeOver просит процесс pid завершиться (SIGTERM, по истечении takeoverTimeout — SIGKILL)
+// и ждёт, пока освободится блокировка f.
+func takeOver(f *os.File, pid int) error {
+	if pid <= 0 || pid == os.Getpid() {
+		return fmt.Errorf("--takeover: в %s нет PID работающего процесса", f.Name())
+	}
+	logState.Info("--takeover: прошу старый процесс завершиться", "pid", pid)
+	_ = syscall.Kill(pid, syscall.SIGTERM)
+	deadline := time.Now().Add(takeoverTimeout)
+	killed := false
+	for {
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+			logState.Info("--takeover: старый процесс завершился, продолжаю", "pid", pid)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if killed {
+				return fmt.Errorf("--takeover: PID %d не освободил блокировку", pid)
+			}
+			logState.Warn("--takeover: старый процесс не завершился, SIGKILL", "pid", pid, "timeout", takeoverTimeout.String())
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			killed = true
+			deadline = time.Now().Add(5 * time.Second)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func readPID(f *os.File) int {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b[:n])))
+	return pid
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const heartbeatPath = "/device/me/heartbeat"
+
+// processStarted — время запуска mediaplayer (для uptime процесса в телеметрии).
+var processStarted = time.Now()
+
+// telemetry — состояние устройства для POST /device/me/heartbeat и строк system.log.
+// Поля, которые не удалось прочитать, остаются пустыми (у указателей — null).
+type telemetry struct {
+	Time      time.Time `json:"time"`
+	Version   string    `json:"version"`
+	Uptime    int64     `json:"uptime"`    // секунды с загрузки ОС
+	AppUptime int64     `json:"appUptime"` // секунды с запуска mediaplayer
+
+	Temperature *float64  `json:"temperature"` // °C, thermal_zone0
+	Load        []float64 `json:"load"`        // средняя загрузка за 1, 5, 15 минут
+	MemTotalMB  int64     `json:"memTotalMb"`
+	MemAvailMB  int64     `json:"memAvailableMb"`
+	DiskTotalMB int64     `json:"diskTotalMb"` // файловая система MEDIA_DIR
+	DiskFreeMB  int64     `json:"diskFreeMb"`
+	// Storage — не хватило ли места при последней синхронизации (null — синхронизаций ещё не было)
+	Storage *diskState `json:"storage"`
+
+	Network networkInfo `json:"network"`
+	Player  playerStats `json:"player"`
+}
+
+// networkInfo — через какой интерфейс идёт маршрут по умолчанию.
+type networkInfo struct {
+	Type      string `json:"type"` // ethernet, wifi, cellular, other, none
+	Interface string `json:"interface,omitempty"`
+}
+
+// collectTelemetry собирает метрики системы и состояние плеера.
+func collectTelemetry(mediaDir string, ps playerStats) telemetry {
+	now := time.Now()
+	t := telemetry{
+		Time:      now.UTC().Round(time.Second),
+		Version:   Version,
+		AppUptime: int64(now.Sub(processStarted).Seconds()),
+		Network:   defaultRouteNetwork(),
+		Player:    ps,
+	}
+	if b, err := os.ReadFile("/proc/uptime"); err == nil {
+		if f := strings.Fields(string(b)); len(f) > 0 {
+			up, _ := strconv.ParseFloat(f[0], 64)
+			t.Uptime = int64(up)
+		}
+	}
+	if b, err := os.ReadFile("/sys/class/thermal/thermal_zone0/temp"); err == nil {
+		if milli, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			c := float64(milli) / 1000
+			t.Temperature = &c
+		}
+	}
+	if b, err := os.ReadFile("/proc/loadavg"); err == nil {
+		f := strings.Fields(string(b))
+		for i := 0; i < 3 && i < len(f); i++ {
+			v, _ := strconv.ParseFloat(f[i], 64)
+			t.Load = append(t.Load, v)
+		}
+	}
+	if b, err := os.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			var kb int64
+			if _, err := fmt.Sscanf(line, "MemTotal: %d", &kb); err == nil {
+				t.MemTotalMB = kb / 1024
+			}
+			if _, err := fmt.Sscanf(line, "MemAvailable: %d", &kb); err == nil {
+				t.MemAvailMB = kb / 1024
+			}
+		}
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mediaDir, &st); err == nil {
+		t.DiskTotalMB = int64(st.Blocks) * int64(st.Bsize) >> 20
+		t.DiskFreeMB = int64(st.Bavail) * int64(st.Bsize) >> 20
+	}
+	t.Storage = diskStatus.Load()
+	return t
+}
+
+// defaultRouteNetwork определяет тип подключения по интерфейсу маршрута по умолчанию из /proc/net/route.
+func defaultRouteNetwork() networkInfo {
+	b, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return networkInfo{Type: "none"}
+	}
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		f := strings.Fields(line)
+		// Iface Destination Gateway Flags ... ; 00000000 — маршрут по умолчанию
+		if len(f) < 2 || f[1] != "00000000" {
+			continue
+		}
+		return networkInfo{Type: interfaceType(f[0]), Interface: f[0]}
+	}
+	return networkInfo{Type: "none"}
+}
+
+// interfaceType — ethernet, wifi или cellular по sysfs и имени интерфейса.
+func interfaceType(iface string) string {
+	sys := filepath.Join("/sys/class/net", iface)
+	if _, err := os.Stat(filepath.Join(sys, "wireless")); err == nil {
+		return "wifi"
+	}
+	for _, p := range []string{"wwan", "wwx", "ppp", "rmnet", "usb"} {
+		if strings.HasPrefix(iface, p) {
+			return "cellular"
+		}
+	}
+	if strings.HasPrefix(iface, "wl") {
+		return "wifi"
+	}
+	// type 1 — ARPHRD_ETHER
+	if b, err := os.ReadFile(filepath.Join(sys, "type")); err == nil && strings.TrimSpace(string(b)) == "1" {
+		return "ethernet"
+	}
+	return "other"
+}
+
+// sendHeartbeat отправляет телеметрию на POST /device/me/heartbeat.
+func sendHeartbeat(au *auth, t telemetry) error {
+	body, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return au.do(func(jwt string) error {
+		req, err := http.NewRequest(http.MethodPost, au.serverURL+heartbeatPath, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			return errUnauthorized
+		}
+		if resp.StatusCode/100 != 2 {
+			bs, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("heartbeat %d: %s", resp.StatusCode, string(bs))
+		}
+		return nil
+	})
+}
+
+// heartbeatNow просит отправить телеметрию вне очереди (например, когда закончилось место).
+var heartbeatNow = make(chan struct{}, 1)
+
+// runHeartbeat отправляет телеметрию каждые interval (первый раз — как только есть JWT), пока не отменён ctx.
+func runHeartbeat(ctx context.Context, au *auth, interval time.Duration, collect func() telemetry) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-heartbeatNow:
+			stopTimer(timer)
+		case <-ctx.Done():
+			return
+		}
+		next := interval
+		if jwt, _ := loadJWT(); jwt == "" {
+			next = 30 * time.Second // ждём чек-ина
+		} else if err := sendHeartbeat(au, collect()); err != nil {
+			logReport.Error("телеметрия не отправлена", "err", err)
+		}
+		timer.Reset(next)
+	}
+}
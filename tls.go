@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// newHTTPClient собирает HTTP-клиент с проверкой TLS: системные корневые сертификаты плюс TLS_CA_FILE,
+// для хоста SERVER_URL — сверка ключа с TLS_PIN_SHA256 (если задан). Без проверки сертификата
+// ходим только на медиа-хосты из TLS_INSECURE_HOSTS. Сертификат устройства (TLS_CLIENT_CERT) предъявляется
+// серверам, которые его запрашивают.
+func newHTTPClient(cfg config) (*http.Client, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS_CA_FILE: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS_CA_FILE %s: нет сертификатов в формате PEM", cfg.TLSCAFile)
+		}
+	}
+	u, err := url.Parse(cfg.ServerURL)
+	if err != nil {
+		return nil, fmt.Errorf("SERVER_URL: %w", err)
+	}
+	serverHost := u.Hostname()
+	if hostListed(serverHost, cfg.TLSInsecureHosts) {
+		return nil, fmt.Errorf("TLS_INSECURE_HOSTS: %s — хост SERVER_URL, отключать для него проверку нельзя", serverHost)
+	}
+	pins, err := parsePins(cfg.TLSPins)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		logMain.Warn("SERVER_URL без https: токен и медиа передаются открыто", "server", cfg.ServerURL)
+	}
+
+	secure := http.DefaultTransport.(*http.Transport).Clone()
+	secure.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	if cfg.TLSClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCert, cfg.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("TLS_CLIENT_CERT: %w", err)
+		}
+		secure.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	t := &hostTransport{secure: secure, serverHost: serverHost, insecureHosts: cfg.TLSInsecureHosts}
+	if len(pins) > 0 {
+		// отдельный транспорт только для SERVER_URL: по ConnectionState хост не узнать, если в URL IP-адрес
+		pinned := secure.Clone()
+		pinned.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			// цепочка уже проверена; закреплён может быть ключ сертификата сервера или любого CA в цепочке
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("TLS: ключ сертификата %s не совпадает с TLS_PIN_SHA256", serverHost)
+		}
+		t.server = pinned
+	}
+	if len(cfg.TLSInsecureHosts) > 0 {
+		logMain.Warn("проверка TLS отключена для медиа-хостов", "hosts", strings.Join(cfg.TLSInsecureHosts, ","))
+		insecure := http.DefaultTransport.(*http.Transport).Clone()
+		insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		t.insecure = insecure
+	}
+	if t.server == nil && t.insecure == nil {
+		return &http.Client{Transport: secure}, nil
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// hostTransport выбирает транспорт по хосту запроса: server (с пиннингом) для SERVER_URL, insecure
+// для хостов из insecureHosts, secure для остальных. Выбор — на каждый запрос, поэтому редирект
+// на другой хост проверяется заново.
+type hostTransport struct {
+	secure, server, insecure http.RoundTripper
+	serverHost               string
+	insecureHosts            []string
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	switch {
+	case t.server != nil && strings.EqualFold(host, t.serverHost):
+		return t.server.RoundTrip(req)
+	case t.insecure != nil && hostListed(host, t.insecureHosts):
+		return t.insecure.RoundTrip(req)
+	}
+	return t.secure.RoundTrip(req)
+}
+
+// hostListed сообщает, есть ли host в списке: точное имя или "*.example.com" для поддоменов.
+func hostListed(host string, hosts []string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(h, "*."); ok && strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePins разбирает SHA-256 от SubjectPublicKeyInfo: base64 (как у HPKP, можно с префиксом "sha256/") или hex.
+func parsePins(list []string) (map[[32]byte]bool, error) {
+	pins := map[[32]byte]bool{}
+	for _, p := range list {
+		raw := strings.TrimPrefix(p, "sha256/")
+		b, err := hex.DecodeString(strings.ReplaceAll(raw, ":", ""))
+		if err != nil || len(b) != sha256.Size {
+			b, err = base64.StdEncoding.DecodeString(raw)
+		}
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("TLS_PIN_SHA256: %q — ожидается SHA-256 ключа в base64 или hex", p)
+		}
+		pins[[32]byte(b)] = true
+	}
+	return pins, nil
+}
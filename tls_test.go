@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParsePins(t *testing.T) {
+	sum := sha256.Sum256([]byte("spki"))
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+	hx := hex.EncodeToString(sum[:])
+	var colons []string
+	for i := 0; i < len(hx); i += 2 {
+		colons = append(colons, strings.ToUpper(hx[i:i+2]))
+	}
+	tests := []struct {
+		name    string
+		list    []string
+		wantErr bool
+	}{
+		{"base64", []string{b64}, false},
+		{"base64 с sha256/", []string{"sha256/" + b64}, false},
+		{"hex", []string{hx}, false},
+		{"hex с двоеточиями", []string{strings.Join(colons, ":")}, false},
+		{"hex с sha256/", []string{"sha256/" + hx}, false},
+		{"короткий hex", []string{hx[:62]}, true},
+		{"base64 не SHA-256", []string{base64.StdEncoding.EncodeToString([]byte("short"))}, true},
+		{"мусор", []string{"not-a-pin"}, true},
+		{"ошибка во втором", []string{b64, "bad"}, true},
+	}
+	for _, tt := range tests {
+		pins, err := parsePins(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parsePins(%q) err = %v, wantErr %v", tt.name, tt.list, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (len(pins) != 1 || !pins[sum]) {
+			t.Errorf("%s: parsePins(%q) = %v, want только %x", tt.name, tt.list, pins, sum)
+		}
+	}
+	if pins, err := parsePins(nil); err != nil || len(pins) != 0 {
+		t.Errorf("parsePins(nil) = %v, %v; want пусто", pins, err)
+	}
+}